@@ -0,0 +1,63 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package quant
+
+import (
+	"image"
+	"image/color"
+)
+
+// AdaptiveSierra24A performs Sierra24A error diffusion dithering while
+// adapting the palette to the image.
+//
+// As each pixel is mapped, the chosen palette color is nudged toward the
+// color it was asked to represent, the pixel color plus diffused error.
+// This reduces overall error for images where the initial palette was
+// suboptimal, blending quantization and dithering into one pass.
+//
+// It is slower than Sierra24A.  Because the palette changes during
+// dithering, pixels mapped early in the image are represented by the
+// final palette colors rather than the colors they were matched against.
+// Results are deterministic; no random numbers are used.
+//
+// It does not satisfy draw.Drawer.  Use Dither, which returns the adapted
+// palette along with the image.
+type AdaptiveSierra24A struct {
+	// Metric, ErrorClamp, and Edge are as with Sierra24A.
+	Metric     Metric
+	ErrorClamp uint16
+	Edge       uint16
+	// Rate is the fraction of the difference by which a palette color is
+	// moved toward the color it represents.  Zero means the default, 1/64.
+	Rate float64
+}
+
+// Dither dithers src to palette cp, returning the dithered image and the
+// adapted palette.  The adapted palette is also the palette of the image.
+// Cp is not modified.
+//
+// Nil is returned if cp has more than 256 colors.
+func (d AdaptiveSierra24A) Dither(src image.Image, cp color.Palette) (*image.Paletted, color.Palette) {
+	if len(cp) > 256 {
+		return nil, nil
+	}
+	rate := d.Rate
+	if rate == 0 {
+		rate = 1. / 64
+	}
+	sp := newSPalette(cp)
+	s := Sierra24A{Metric: d.Metric, ErrorClamp: d.ErrorClamp, Edge: d.Edge}
+	pi := s.diffuse(src, cp, sp, func(i int, afc sRGB) {
+		c := &sp[i]
+		c.r += int32(rate * float64(afc.r-c.r))
+		c.g += int32(rate * float64(afc.g-c.g))
+		c.b += int32(rate * float64(afc.b-c.b))
+	})
+	ap := make(color.Palette, len(sp))
+	for i, c := range sp {
+		ap[i] = color.RGBA64{uint16(c.r), uint16(c.g), uint16(c.b), 0xffff}
+	}
+	pi.Palette = ap
+	return pi, ap
+}
@@ -0,0 +1,70 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package quant
+
+import (
+	"image"
+	"image/draw"
+
+	"github.com/soniakeys/quant/internal"
+)
+
+// Thresholds of the AutoDither heuristic.  They may be changed to tune
+// the choice of drawer.
+var (
+	// AutoDitherFlat is the fraction of horizontally adjacent pixel pairs
+	// of identical color above which an image is considered flat graphics.
+	AutoDitherFlat = .6
+	// AutoDitherEdge is the fraction of non-identical pixel pairs differing
+	// by more than 1/8 of full range in luminance, above which an image is
+	// considered to be dominated by edges rather than gradients.
+	AutoDitherEdge = .25
+)
+
+// AutoDither returns a drawer suited to the content of img.
+//
+// The heuristic compares horizontally adjacent pixels.  If a large fraction
+// of pairs, AutoDitherFlat, are identical, the image is taken to be flat
+// graphics and draw.Src is returned, mapping pixels to nearest palette
+// colors without dithering to avoid noise on solid fills.  Otherwise if
+// a large fraction of the remaining pairs, AutoDitherEdge, differ strongly
+// in luminance, Ordered is returned, keeping edges crisper than error
+// diffusion.  Otherwise the image is taken to be photographic and Sierra24A
+// is returned.
+//
+// The result is only a default.  Callers are free to use any drawer.
+func AutoDither(img image.Image) draw.Drawer {
+	pxRGBA := internal.PxRGBAfunc(img)
+	b := img.Bounds()
+	var pairs, flat, edge int
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		r0, g0, b0, a0 := pxRGBA(b.Min.X, y)
+		for x := b.Min.X + 1; x < b.Max.X; x++ {
+			r1, g1, b1, a1 := pxRGBA(x, y)
+			pairs++
+			if r1 == r0 && g1 == g0 && b1 == b0 && a1 == a0 {
+				flat++
+			} else {
+				d := luminance(r1, g1, b1) - luminance(r0, g0, b0)
+				if d > 0x2000 || d < -0x2000 {
+					edge++
+				}
+			}
+			r0, g0, b0, a0 = r1, g1, b1, a1
+		}
+	}
+	switch {
+	case pairs == 0 || float64(flat) > AutoDitherFlat*float64(pairs):
+		return draw.Src
+	case float64(edge) > AutoDitherEdge*float64(pairs-flat):
+		return Ordered{}
+	}
+	return Sierra24A{}
+}
+
+// luminance returns the luma of 16 bit RGB values, using the Rec. 601
+// coefficients as color.GrayModel does.
+func luminance(r, g, b uint32) int32 {
+	return int32((19595*r + 38470*g + 7471*b + 1<<15) >> 16)
+}
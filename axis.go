@@ -0,0 +1,66 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package quant
+
+import (
+	"image/color"
+	"math"
+)
+
+// Axis values identify the axes, or channels, of RGB color space.
+//
+// They are the values returned by WidestAxis and are the axes the median
+// and mean quantizers split clusters on.
+const (
+	AxisR = iota // red
+	AxisG        // green
+	AxisB        // blue
+)
+
+// WidestAxis returns the RGB axis with the widest range of values over
+// colors, with the minimum and maximum values on that axis.
+//
+// Values are those of the RGBA method, alpha-premultiplied in the range
+// [0, 0xffff].  Ties favor green, then red, following the relative
+// sensitivity of the eye.  This is the rule the quantizers use to choose
+// the axis to split a cluster on.  For no colors, WidestAxis returns AxisG
+// and zero values.
+func WidestAxis(colors []color.Color) (axis int, min, max uint32) {
+	if len(colors) == 0 {
+		return AxisG, 0, 0
+	}
+	var maxR, maxG, maxB uint32
+	minR := uint32(math.MaxUint32)
+	minG := uint32(math.MaxUint32)
+	minB := uint32(math.MaxUint32)
+	for _, c := range colors {
+		r, g, b, _ := c.RGBA()
+		if r < minR {
+			minR = r
+		}
+		if r > maxR {
+			maxR = r
+		}
+		if g < minG {
+			minG = g
+		}
+		if g > maxG {
+			maxG = g
+		}
+		if b < minB {
+			minB = b
+		}
+		if b > maxB {
+			maxB = b
+		}
+	}
+	axis, min, max = AxisG, minG, maxG
+	if maxR-minR > max-min {
+		axis, min, max = AxisR, minR, maxR
+	}
+	if maxB-minB > max-min {
+		axis, min, max = AxisB, minB, maxB
+	}
+	return
+}
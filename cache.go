@@ -0,0 +1,99 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package quant
+
+import "image/color"
+
+// CachingPalette wraps a Palette, caching results of IndexNear and
+// ColorNear.
+//
+// The cache is direct-mapped, keyed by 16 bit RGBA color.  For images with
+// long runs of the same color, such as backgrounds and flat fills, most
+// lookups are then cache hits.  Results are identical to those of the
+// wrapped palette.
+//
+// A CachingPalette is not safe for concurrent use.
+type CachingPalette struct {
+	Palette
+	cache []cacheEntry
+	mask  uint64
+}
+
+type cacheEntry struct {
+	key  uint64
+	used bool
+	i    int         // IndexNear result, or -1 if not cached
+	c    color.Color // ColorNear result, or nil if not cached
+}
+
+// NewCachingPalette returns a CachingPalette wrapping p with a cache of
+// the given size, rounded up to a power of 2.  Size < 1 means a default
+// of 256.
+func NewCachingPalette(p Palette, size int) *CachingPalette {
+	if size < 1 {
+		size = 256
+	}
+	n := 1
+	for n < size {
+		n *= 2
+	}
+	return &CachingPalette{
+		Palette: p,
+		cache:   make([]cacheEntry, n),
+		mask:    uint64(n - 1),
+	}
+}
+
+// entry returns the cache entry for c, cleared if it held another color.
+func (p *CachingPalette) entry(c color.Color) *cacheEntry {
+	return p.entryRGBA(c.RGBA())
+}
+
+// entryRGBA is entry for channel values.
+func (p *CachingPalette) entryRGBA(r, g, b, a uint32) *cacheEntry {
+	key := uint64(r)<<48 | uint64(g)<<32 | uint64(b)<<16 | uint64(a)
+	e := &p.cache[hash(key, 0, 0)&p.mask]
+	if !e.used || e.key != key {
+		*e = cacheEntry{key: key, used: true, i: -1}
+	}
+	return e
+}
+
+// IndexNear returns the IndexNear result of the wrapped palette.
+func (p *CachingPalette) IndexNear(c color.Color) int {
+	e := p.entry(c)
+	if e.i < 0 {
+		e.i = p.Palette.IndexNear(c)
+	}
+	return e.i
+}
+
+// IndexNearRGB returns the IndexNear result of the wrapped palette for the
+// opaque color with channel values r, g, b, as returned by the RGBA method.
+//
+// If the wrapped palette has an IndexNearRGB method, as LinearPalette and
+// TreePalette do, it is used for cache misses.
+func (p *CachingPalette) IndexNearRGB(r, g, b uint32) int {
+	e := p.entryRGBA(r, g, b, 0xffff)
+	if e.i < 0 {
+		if rp, ok := p.Palette.(interface {
+			IndexNearRGB(r, g, b uint32) int
+		}); ok {
+			e.i = rp.IndexNearRGB(r, g, b)
+		} else {
+			e.i = p.Palette.IndexNear(color.RGBA64{
+				uint16(r), uint16(g), uint16(b), 0xffff})
+		}
+	}
+	return e.i
+}
+
+// ColorNear returns the ColorNear result of the wrapped palette.
+func (p *CachingPalette) ColorNear(c color.Color) color.Color {
+	e := p.entry(c)
+	if e.c == nil {
+		e.c = p.Palette.ColorNear(c)
+	}
+	return e.c
+}
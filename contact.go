@@ -0,0 +1,93 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package quant
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"strconv"
+)
+
+// ContactSheet returns a single image comparing img quantized to each
+// number of colors in ns.
+//
+// Results are tiled in rows, in the order of ns, each labeled below with
+// its number of colors.  The number of colors is determined by calling
+// the draw.Quantizer method Quantize of q with a palette of capacity n.
+// The quantizers of this source tree all implement draw.Quantizer.  If q
+// does not, all tiles show the result of q.Paletted.  As with Paletted,
+// n is limited to 256.
+func ContactSheet(img image.Image, q Quantizer, ns []int) image.Image {
+	const gap = 4
+	b := img.Bounds()
+	cols := int(math.Ceil(math.Sqrt(float64(len(ns)))))
+	rows := 0
+	if cols > 0 {
+		rows = (len(ns) + cols - 1) / cols
+	}
+	cw := b.Dx() + gap
+	ch := b.Dy() + labelHeight + gap
+	sheet := image.NewRGBA(image.Rect(0, 0, cols*cw+gap, rows*ch+gap))
+	draw.Draw(sheet, sheet.Rect, image.White, image.Point{}, draw.Src)
+	dq, ok := q.(draw.Quantizer)
+	for i, n := range ns {
+		if n > 256 {
+			n = 256
+		}
+		var pi *image.Paletted
+		if ok && n > 0 {
+			cp := dq.Quantize(make(color.Palette, 0, n), img)
+			pi = Paletted(LinearPalette{Palette: cp}, img)
+		} else {
+			pi = q.Paletted(img)
+		}
+		at := image.Pt(gap+i%cols*cw, gap+i/cols*ch)
+		draw.Draw(sheet, b.Sub(b.Min).Add(at), pi, b.Min, draw.Src)
+		label(sheet, at.Add(image.Pt(0, b.Dy()+2)), strconv.Itoa(ns[i]))
+	}
+	return sheet
+}
+
+// labelHeight is the height in pixels of text drawn by label, including
+// space above and below.
+const labelHeight = 5*labelScale + 4
+
+// labelScale is the size in pixels of each dot of the label font.
+const labelScale = 2
+
+// digits is a 3x5 dot font of decimal digits and the minus sign.  Each
+// row is 3 bits, the high bit leftmost.
+var digits = map[rune][5]uint8{
+	'0': {7, 5, 5, 5, 7},
+	'1': {2, 6, 2, 2, 7},
+	'2': {7, 1, 7, 4, 7},
+	'3': {7, 1, 3, 1, 7},
+	'4': {5, 5, 7, 1, 1},
+	'5': {7, 4, 7, 1, 7},
+	'6': {7, 4, 7, 5, 7},
+	'7': {7, 1, 1, 2, 2},
+	'8': {7, 5, 7, 5, 7},
+	'9': {7, 5, 7, 1, 7},
+	'-': {0, 0, 7, 0, 0},
+}
+
+// label draws text s in black on dst with its upper left corner at pt.
+// Characters other than digits and the minus sign are drawn as spaces.
+func label(dst draw.Image, pt image.Point, s string) {
+	for _, r := range s {
+		for y, row := range digits[r] {
+			for x := 0; x < 3; x++ {
+				if row&(4>>uint(x)) == 0 {
+					continue
+				}
+				dot := image.Rect(0, 0, labelScale, labelScale).
+					Add(pt.Add(image.Pt(x*labelScale, y*labelScale)))
+				draw.Draw(dst, dot, image.Black, image.Point{}, draw.Src)
+			}
+		}
+		pt.X += 4 * labelScale
+	}
+}
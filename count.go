@@ -0,0 +1,50 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package quant
+
+import (
+	"image"
+
+	"github.com/soniakeys/quant/internal"
+)
+
+// CountColors counts distinct colors of img at 16 bit precision.
+//
+// Counting stops once the count exceeds limit.  Returned is the exact count
+// if it is no more than limit, otherwise limit.  The result is useful for
+// choosing a number of colors for quantization.
+func CountColors(img image.Image, limit int) int {
+	pxRGBA := internal.PxRGBAfunc(img)
+	b := img.Bounds()
+	seen := map[uint64]struct{}{}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := pxRGBA(x, y)
+			seen[uint64(r)<<48|uint64(g)<<32|uint64(bl)<<16|uint64(a)] = struct{}{}
+			if len(seen) > limit {
+				return limit
+			}
+		}
+	}
+	return len(seen)
+}
+
+// Usage returns the number of pixels of pi using each palette index.
+//
+// The result is indexed as pi.Palette.  Indexes with a count of zero are
+// palette entries not used by the image.  Pixel indexes outside of the
+// palette are not counted.
+func Usage(pi *image.Paletted) []int {
+	u := make([]int, len(pi.Palette))
+	w := pi.Rect.Dx()
+	for y := pi.Rect.Min.Y; y < pi.Rect.Max.Y; y++ {
+		i := pi.PixOffset(pi.Rect.Min.X, y)
+		for _, x := range pi.Pix[i : i+w] {
+			if int(x) < len(u) {
+				u[x]++
+			}
+		}
+	}
+	return u
+}
@@ -0,0 +1,48 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package quant
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// Fixed palettes of common e-ink display panels.  Index order is black,
+// white, and then red for EInkBWR, and dark to light for the gray palettes.
+// Panel controllers differ in their pixel encodings, so indexes may need
+// mapping to the values a particular controller expects.
+var (
+	EInkBW     = LinearPalette{Palette: color.Palette{color.Black, color.White}}
+	EInk4Gray  = LinearPalette{Palette: grays(4)}
+	EInk16Gray = LinearPalette{Palette: grays(16)}
+	EInkBWR    = LinearPalette{Palette: color.Palette{
+		color.Black,
+		color.White,
+		color.RGBA{0xff, 0, 0, 0xff},
+	}}
+)
+
+// EInkDrawer is the drawer recommended for e-ink palettes.  Palettes are
+// small and fixed, so error diffusion is needed to represent intermediate
+// tones.
+var EInkDrawer draw.Drawer = Sierra24A{}
+
+// EInk maps img to fixed palette p, typically one of the e-ink palettes of
+// this package, using EInkDrawer.
+func EInk(img image.Image, p Palette) *image.Paletted {
+	b := img.Bounds()
+	pi := image.NewPaletted(b, p.ColorPalette())
+	EInkDrawer.Draw(pi, b, img, b.Min)
+	return pi
+}
+
+// grays returns a palette of n evenly spaced grays from black to white.
+func grays(n int) color.Palette {
+	p := make(color.Palette, n)
+	for i := range p {
+		p[i] = color.Gray{uint8(i * 255 / (n - 1))}
+	}
+	return p
+}
@@ -0,0 +1,64 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package quant
+
+import (
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/soniakeys/quant/internal"
+)
+
+// ErrorImage returns a grayscale image showing where quantization error
+// concentrates when orig is mapped to palette p.
+//
+// Each pixel of orig is mapped with p.ColorNear.  The value of the result
+// pixel is the Euclidean RGB distance between the original and palette
+// colors, in 8 bit units and limited to 255.  Black is thus no error and
+// brighter pixels are greater error.
+func ErrorImage(orig image.Image, p Palette) *image.Gray {
+	pxRGBA := internal.PxRGBAfunc(orig)
+	b := orig.Bounds()
+	g := image.NewGray(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r0, g0, b0, a0 := pxRGBA(x, y)
+			c := color.RGBA64{uint16(r0), uint16(g0), uint16(b0), uint16(a0)}
+			r1, g1, b1, _ := p.ColorNear(c).RGBA()
+			s := sRGB{int32(r0), int32(g0), int32(b0)}
+			d := math.Sqrt(float64(s.dist(sRGB{int32(r1), int32(g1), int32(b1)}))) / 0x101
+			if d > 255 {
+				d = 255
+			}
+			g.SetGray(x, y, color.Gray{uint8(d + .5)})
+		}
+	}
+	return g
+}
+
+// MSE returns the mean squared error between images a and b, such as an
+// original image and a quantized image.
+//
+// The error is the mean over pixels and RGB channels of squared
+// differences in 8 bit units.  Pixels are compared over the intersection
+// of the bounds of a and b.  Zero is returned if the intersection is empty.
+func MSE(a, b image.Image) float64 {
+	r := a.Bounds().Intersect(b.Bounds())
+	if r.Empty() {
+		return 0
+	}
+	pa := internal.PxRGBAfunc(a)
+	pb := internal.PxRGBAfunc(b)
+	var sum float64
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			r0, g0, b0, _ := pa(x, y)
+			r1, g1, b1, _ := pb(x, y)
+			s := sRGB{int32(r0), int32(g0), int32(b0)}
+			sum += float64(s.dist(sRGB{int32(r1), int32(g1), int32(b1)}))
+		}
+	}
+	return sum / (0x101 * 0x101 * 3 * float64(r.Dx()*r.Dy()))
+}
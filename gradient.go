@@ -0,0 +1,74 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package quant
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// GradientMap satisfies draw.Drawer, mapping image luminance onto a
+// gradient of colors such as a duotone or tritone, with error diffusion
+// dithering between adjacent gradient stops.
+//
+// Stops are spaced evenly along the luminance range, the first for black
+// and the last for white.  Unlike other drawers of this package, colors
+// are chosen by luminance position along the gradient rather than by
+// nearest color in RGB space, so stops may be any colors at all.
+type GradientMap struct {
+	// Stops is the ordered gradient.  Nil means the palette of the
+	// destination image, in palette order.
+	Stops color.Palette
+}
+
+var _ draw.Drawer = GradientMap{}
+
+// Draw performs gradient mapping.
+//
+// This method satisfies the draw.Drawer interface.  As with Sierra24A,
+// dst must be an *image.Paletted for dithering to be done.  Pixels are set
+// to the indexes of the dst palette colors nearest the stops.
+func (d GradientMap) Draw(dst draw.Image, r image.Rectangle, src image.Image, sp image.Point) {
+	drawPaletted(dst, r, src, sp, func(src image.Image, cp color.Palette) *image.Paletted {
+		pi := image.NewPaletted(src.Bounds(), cp)
+		if len(cp) == 0 || len(cp) > 256 {
+			return pi
+		}
+		stops := d.Stops
+		if stops == nil {
+			stops = cp
+		}
+		idx := make([]uint8, len(stops))
+		for i, c := range stops {
+			idx[i] = uint8(cp.Index(c))
+		}
+		diffuseLevels(src, pi, stopLevels(len(stops)), idx)
+		return pi
+	})
+}
+
+// Dither returns src mapped to a new image with palette d.Stops.
+// Nil is returned if there are no stops or more than 256.
+func (d GradientMap) Dither(src image.Image) *image.Paletted {
+	if len(d.Stops) == 0 || len(d.Stops) > 256 {
+		return nil
+	}
+	pi := image.NewPaletted(src.Bounds(), d.Stops)
+	idx := make([]uint8, len(d.Stops))
+	for i := range idx {
+		idx[i] = uint8(i)
+	}
+	diffuseLevels(src, pi, stopLevels(len(d.Stops)), idx)
+	return pi
+}
+
+// stopLevels returns luminance levels of n evenly spaced gradient stops.
+func stopLevels(n int) []int32 {
+	l := make([]int32, n)
+	for i := 1; i < n; i++ {
+		l[i] = int32(i * 0xffff / (n - 1))
+	}
+	return l
+}
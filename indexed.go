@@ -0,0 +1,134 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package quant
+
+import (
+	"image"
+	"image/color"
+)
+
+// IndexedImage is like image.Paletted but with 16 bit palette indexes.
+//
+// It holds images of palettes with more than the 256 colors of
+// image.Paletted, up to 65536 colors, for formats or further processing
+// that support wide indexes.  The standard APIs of this module, Paletted
+// for example, continue to limit the number of colors to 256.  Use
+// IndexedImage only where more colors are explicitly wanted.
+type IndexedImage struct {
+	// Pix holds the image's palette indexes, in Y, X order.  The pixel at
+	// (x, y) is at Pix[(y-Rect.Min.Y)*Stride + (x-Rect.Min.X)].
+	Pix []uint16
+	// Stride is the Pix stride (in indexes) between vertically adjacent
+	// pixels.
+	Stride int
+	// Rect is the image's bounds.
+	Rect image.Rectangle
+	// Palette is the image's palette.
+	Palette color.Palette
+}
+
+// NewIndexedImage returns a new IndexedImage with the given bounds and
+// palette.
+func NewIndexedImage(r image.Rectangle, p color.Palette) *IndexedImage {
+	w, h := r.Dx(), r.Dy()
+	if w < 0 || h < 0 {
+		w, h = 0, 0
+	}
+	return &IndexedImage{
+		Pix:     make([]uint16, w*h),
+		Stride:  w,
+		Rect:    r,
+		Palette: p,
+	}
+}
+
+// ColorModel returns the palette of the image.
+func (p *IndexedImage) ColorModel() color.Model { return p.Palette }
+
+// Bounds returns the image bounds.
+func (p *IndexedImage) Bounds() image.Rectangle { return p.Rect }
+
+// At returns the palette color of the pixel at (x, y).
+//
+// As with image.Paletted, At returns Palette[0] for points outside of the
+// image bounds.  It returns nil for an empty palette or for indexes outside
+// of the palette.
+func (p *IndexedImage) At(x, y int) color.Color {
+	if len(p.Palette) == 0 {
+		return nil
+	}
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return p.Palette[0]
+	}
+	i := p.Pix[p.PixOffset(x, y)]
+	if int(i) >= len(p.Palette) {
+		return nil
+	}
+	return p.Palette[i]
+}
+
+// PixOffset returns the index of the element of Pix that corresponds to
+// the pixel at (x, y).
+func (p *IndexedImage) PixOffset(x, y int) int {
+	return (y-p.Rect.Min.Y)*p.Stride + (x - p.Rect.Min.X)
+}
+
+// Set sets the pixel at (x, y) to the index of the palette color nearest c.
+func (p *IndexedImage) Set(x, y int, c color.Color) {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return
+	}
+	p.Pix[p.PixOffset(x, y)] = uint16(p.Palette.Index(c))
+}
+
+// ColorIndexAt returns the palette index of the pixel at (x, y).
+func (p *IndexedImage) ColorIndexAt(x, y int) uint16 {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return 0
+	}
+	return p.Pix[p.PixOffset(x, y)]
+}
+
+// SetColorIndex sets the palette index of the pixel at (x, y).
+func (p *IndexedImage) SetColorIndex(x, y int, index uint16) {
+	if !(image.Point{x, y}.In(p.Rect)) {
+		return
+	}
+	p.Pix[p.PixOffset(x, y)] = index
+}
+
+// SubImage returns an image representing the portion of the image p
+// visible through r.  The returned value shares pixels with the original
+// image.
+func (p *IndexedImage) SubImage(r image.Rectangle) image.Image {
+	r = r.Intersect(p.Rect)
+	if r.Empty() {
+		return &IndexedImage{Palette: p.Palette}
+	}
+	return &IndexedImage{
+		Pix:     p.Pix[p.PixOffset(r.Min.X, r.Min.Y):],
+		Stride:  p.Stride,
+		Rect:    r,
+		Palette: p.Palette,
+	}
+}
+
+// Indexed returns an IndexedImage of img using palette p.
+//
+// It is like Paletted but for palettes of up to 65536 colors.  Each pixel
+// is set to the index returned by p.IndexNear.  Nil is returned if p has
+// more than 65536 colors.
+func Indexed(p Palette, img image.Image) *IndexedImage {
+	if p.Len() > 1<<16 {
+		return nil
+	}
+	b := img.Bounds()
+	ii := NewIndexedImage(b, p.ColorPalette())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			ii.SetColorIndex(x, y, uint16(p.IndexNear(img.At(x, y))))
+		}
+	}
+	return ii
+}
@@ -3,7 +3,10 @@
 
 package internal
 
-import "image"
+import (
+	"image"
+	"math"
+)
 
 // PxRGBAfunc returns function to get RGBA color values at (x, y) coordinates of
 // image img. Returned function works the same as img.At(x, y).RGBA() but
@@ -20,3 +23,128 @@ func PxRGBAfunc(img image.Image) func(x, y int) (r, g, b, a uint32) {
 	}
 	return func(x, y int) (r, g, b, a uint32) { return img.At(x, y).RGBA() }
 }
+
+// PxIndexRGBAfunc returns a function to get RGBA color values of image img
+// by pixel index, where index i represents the pixel at column i % w and row
+// i / w of the bounds of img, w being the width of the bounds.
+//
+// Like PxRGBAfunc it bypasses color.Color for certain image types.  Pixels
+// of an *image.RGBA with no padding between rows are read directly by
+// offset into Pix.
+func PxIndexRGBAfunc(img image.Image) func(i int) (r, g, b, a uint32) {
+	bd := img.Bounds()
+	w := bd.Dx()
+	if img0, ok := img.(*image.RGBA); ok && img0.Stride == 4*w {
+		pix := img0.Pix[img0.PixOffset(bd.Min.X, bd.Min.Y):]
+		return func(i int) (r, g, b, a uint32) {
+			s := pix[4*i : 4*i+4 : 4*i+4]
+			r = uint32(s[0])
+			r |= r << 8
+			g = uint32(s[1])
+			g |= g << 8
+			b = uint32(s[2])
+			b |= b << 8
+			a = uint32(s[3])
+			a |= a << 8
+			return
+		}
+	}
+	pxRGBA := PxRGBAfunc(img)
+	return func(i int) (r, g, b, a uint32) {
+		return pxRGBA(bd.Min.X+i%w, bd.Min.Y+i/w)
+	}
+}
+
+// CachedPxIndexRGBAfunc is like PxIndexRGBAfunc but calls At at most once
+// per pixel.
+//
+// Image types of the standard image package, where At is cheap, are read
+// without caching.  For other types, such as procedurally generated images
+// where At may be expensive, all pixels are read once with At and held in
+// a cache of 16 bit values, 8 bytes per pixel.  The returned function then
+// reads from the cache however often it is called.
+func CachedPxIndexRGBAfunc(img image.Image) func(i int) (r, g, b, a uint32) {
+	if stdImage(img) {
+		return PxIndexRGBAfunc(img)
+	}
+	bd := img.Bounds()
+	c := make([]uint16, 0, 4*bd.Dx()*bd.Dy())
+	for y := bd.Min.Y; y < bd.Max.Y; y++ {
+		for x := bd.Min.X; x < bd.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			c = append(c, uint16(r), uint16(g), uint16(b), uint16(a))
+		}
+	}
+	return func(i int) (r, g, b, a uint32) {
+		s := c[4*i : 4*i+4 : 4*i+4]
+		return uint32(s[0]), uint32(s[1]), uint32(s[2]), uint32(s[3])
+	}
+}
+
+// CachedPxRGBAfunc is like PxRGBAfunc but calls At at most once per pixel.
+// See CachedPxIndexRGBAfunc.
+func CachedPxRGBAfunc(img image.Image) func(x, y int) (r, g, b, a uint32) {
+	if stdImage(img) {
+		return PxRGBAfunc(img)
+	}
+	bd := img.Bounds()
+	w := bd.Dx()
+	f := CachedPxIndexRGBAfunc(img)
+	return func(x, y int) (r, g, b, a uint32) {
+		return f((y-bd.Min.Y)*w + x - bd.Min.X)
+	}
+}
+
+// stdImage reports whether img is of a type of the standard image package,
+// with an At method that reads pixel data without computation beyond color
+// conversion.
+func stdImage(img image.Image) bool {
+	switch img.(type) {
+	case *image.RGBA, *image.RGBA64, *image.NRGBA, *image.NRGBA64,
+		*image.Alpha, *image.Alpha16, *image.Gray, *image.Gray16,
+		*image.CMYK, *image.Paletted, *image.YCbCr, *image.NYCbCrA,
+		*image.Uniform:
+		return true
+	}
+	return false
+}
+
+// ToLinear converts a 16 bit sRGB encoded channel value, as returned by
+// color.Color.RGBA, to linear light in the range 0 to 1.
+func ToLinear(v uint32) float64 {
+	s := float64(v) / 0xffff
+	if s <= 0.04045 {
+		return s / 12.92
+	}
+	return math.Pow((s+0.055)/1.055, 2.4)
+}
+
+// FromLinear converts linear light to a 16 bit sRGB encoded channel value.
+// Values of l outside the range 0 to 1 are clamped.
+func FromLinear(l float64) uint32 {
+	switch {
+	case l <= 0:
+		return 0
+	case l >= 1:
+		return 0xffff
+	case l <= 0.0031308:
+		return uint32(l*12.92*0xffff + .5)
+	}
+	return uint32((1.055*math.Pow(l, 1/2.4)-0.055)*0xffff + .5)
+}
+
+// Lab converts 16 bit sRGB values to CIE L*a*b* with a D65 white point.
+func Lab(r, g, b uint32) (l, a, bb float64) {
+	lr, lg, lb := ToLinear(r), ToLinear(g), ToLinear(b)
+	x := (0.4124*lr + 0.3576*lg + 0.1805*lb) / 0.95047
+	y := 0.2126*lr + 0.7152*lg + 0.0722*lb
+	z := (0.0193*lr + 0.1192*lg + 0.9505*lb) / 1.08883
+	f := func(t float64) float64 {
+		if t > 216./24389 {
+			return math.Cbrt(t)
+		}
+		return (24389./27*t + 16) / 116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+	return 116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)
+}
@@ -0,0 +1,111 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+// Package testimage has test images and checks shared by the tests of
+// the quant packages.
+package testimage
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/soniakeys/quant"
+)
+
+// Synthetic returns a small test image generated in code.  It has
+// smooth gradients, flat regions, and noise, and is identical on every call.
+func Synthetic() *image.NRGBA {
+	const w, h = 64, 64
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	var seed uint32 = 1 // xorshift state, fixed for reproducibility
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var c color.NRGBA
+			switch {
+			case y < h/2: // gradients, red to blue across, green down
+				c = color.NRGBA{
+					uint8(255 - x*255/(w-1)),
+					uint8(y * 255 / (h/2 - 1)),
+					uint8(x * 255 / (w - 1)),
+					255}
+			case x < w/2: // flat regions
+				c = [4]color.NRGBA{
+					{255, 255, 255, 255},
+					{200, 40, 40, 255},
+					{40, 120, 40, 255},
+					{0, 0, 0, 255},
+				}[(x/(w/4))+2*((y-h/2)/(h/4))]
+			default: // noise
+				seed ^= seed << 13
+				seed ^= seed >> 17
+				seed ^= seed << 5
+				c = color.NRGBA{uint8(seed), uint8(seed >> 8), uint8(seed >> 16), 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// SqDiff returns the squared RGB distance between colors c and d.
+func SqDiff(c, d color.Color) uint64 {
+	r0, g0, b0, _ := c.RGBA()
+	r1, g1, b1, _ := d.RGBA()
+	sq := func(a, b uint32) uint64 {
+		d := int64(a) - int64(b)
+		return uint64(d * d)
+	}
+	return sq(r0, r1) + sq(g0, g1) + sq(b0, b1)
+}
+
+// Quantizer is the part of the mean and median quantizers exercised by
+// TinyImages.
+type Quantizer interface {
+	Paletted(image.Image) *image.Paletted
+	Palette(image.Image) quant.Palette
+}
+
+// TinyImages checks quantizers returned by q for n colors, for n from 1
+// to 256, on images of 0 to 20 pixels.  Each must give min(n, distinct
+// colors) colors and, with enough colors, reproduce every pixel exactly.
+func TinyImages(t *testing.T, q func(n int) Quantizer) {
+	for npx := 0; npx <= 20; npx++ {
+		for _, w := range []int{1, 2, 3, 5} {
+			if npx%w != 0 || npx == 0 && w > 1 {
+				continue
+			}
+			// colors repeat every 7 pixels
+			img := image.NewNRGBA(image.Rect(0, 0, w, npx/w))
+			distinct := 0
+			for i := 0; i < npx; i++ {
+				c := i % 7
+				if i < 7 {
+					distinct++
+				}
+				img.SetNRGBA(i%w, i/w, color.NRGBA{uint8(c * 40), uint8(c * 30 % 256), uint8(255 - c*20), 0xff})
+			}
+			for n := 1; n <= 256; n++ {
+				want := n
+				if distinct < want {
+					want = distinct
+				}
+				pi := q(n).Paletted(img)
+				p := q(n).Palette(img)
+				if len(pi.Palette) != want || p.Len() != want {
+					t.Fatalf("%d pixels wide %d, n=%d: %d colors, Palette Len %d, want %d",
+						npx, w, n, len(pi.Palette), p.Len(), want)
+				}
+				// with enough colors, every pixel is reproduced exactly
+				if n >= distinct {
+					for i := 0; i < npx; i++ {
+						if SqDiff(pi.At(i%w, i/w), img.At(i%w, i/w)) != 0 {
+							t.Fatalf("%d pixels wide %d, n=%d: pixel %d is %v, want %v",
+								npx, w, n, i, pi.At(i%w, i/w), img.At(i%w, i/w))
+						}
+					}
+				}
+			}
+		}
+	}
+}
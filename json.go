@@ -0,0 +1,167 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package quant
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/color"
+)
+
+// jsonColor is the JSON form of a color, 16 bit alpha-premultiplied values
+// as returned by color.Color.RGBA in an array [r, g, b, a].
+type jsonColor [4]uint16
+
+func newJSONColor(c color.Color) jsonColor {
+	r, g, b, a := c.RGBA()
+	return jsonColor{uint16(r), uint16(g), uint16(b), uint16(a)}
+}
+
+func (c jsonColor) rgba64() color.RGBA64 {
+	return color.RGBA64{c[0], c[1], c[2], c[3]}
+}
+
+type jsonLinear struct {
+	Colors []jsonColor `json:"colors"`
+}
+
+// MarshalJSON encodes p as a JSON object with colors as [r, g, b, a] arrays
+// of 16 bit values, for example
+//
+//	{"colors":[[0,0,0,65535],[65535,65535,65535,65535]]}
+func (p LinearPalette) MarshalJSON() ([]byte, error) {
+	j := jsonLinear{Colors: make([]jsonColor, len(p.Palette))}
+	for i, c := range p.Palette {
+		j.Colors[i] = newJSONColor(c)
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON decodes the JSON form of MarshalJSON.  Colors are decoded
+// as color.RGBA64 values.
+func (p *LinearPalette) UnmarshalJSON(b []byte) error {
+	var j jsonLinear
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	p.Palette = make(color.Palette, len(j.Colors))
+	for i, c := range j.Colors {
+		p.Palette[i] = c.rgba64()
+	}
+	return nil
+}
+
+// MarshalJSON encodes p in the form of LinearPalette.
+func (p ManhattanPalette) MarshalJSON() ([]byte, error) {
+	return LinearPalette{p.Palette}.MarshalJSON()
+}
+
+// UnmarshalJSON decodes the JSON form of MarshalJSON.
+func (p *ManhattanPalette) UnmarshalJSON(b []byte) error {
+	var l LinearPalette
+	if err := l.UnmarshalJSON(b); err != nil {
+		return err
+	}
+	p.Palette = l.Palette
+	return nil
+}
+
+// jsonNode is the JSON form of a Node.  Leaves have Index and Color, split
+// nodes have Channel, Split, Low, and High.
+type jsonNode struct {
+	Index   int        `json:"index,omitempty"`
+	Color   *jsonColor `json:"color,omitempty"`
+	Channel string     `json:"channel,omitempty"`
+	Split   uint32     `json:"split,omitempty"`
+	Low     *jsonNode  `json:"low,omitempty"`
+	High    *jsonNode  `json:"high,omitempty"`
+}
+
+type jsonTree struct {
+	Leaves int       `json:"leaves"`
+	Root   *jsonNode `json:"root,omitempty"`
+}
+
+// channel names of split node types in JSON.
+var jsonChannel = map[int]string{TSplitR: "r", TSplitG: "g", TSplitB: "b"}
+
+// MarshalJSON encodes t as a JSON object preserving the tree structure so
+// that lookups by the decoded tree are the same.  Leaves are objects with
+// fields "index" and "color", with color as with LinearPalette.  Split
+// nodes have fields "channel", one of "r", "g", or "b", "split", the split
+// value, and child nodes "low" and "high".
+//
+// An error is returned if t is not valid by Validate.
+func (t TreePalette) MarshalJSON() ([]byte, error) {
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	var enc func(n *Node) *jsonNode
+	enc = func(n *Node) *jsonNode {
+		if n.Type == TLeaf {
+			c := newJSONColor(n.Color)
+			return &jsonNode{Index: n.Index, Color: &c}
+		}
+		return &jsonNode{
+			Channel: jsonChannel[n.Type],
+			Split:   n.Split,
+			Low:     enc(n.Low),
+			High:    enc(n.High),
+		}
+	}
+	j := jsonTree{Leaves: t.Leaves}
+	if t.Root != nil {
+		j.Root = enc(t.Root)
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON decodes the JSON form of MarshalJSON.  An error is returned
+// if the decoded tree is not valid by Validate.
+func (t *TreePalette) UnmarshalJSON(b []byte) error {
+	var j jsonTree
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	var dec func(j *jsonNode) (*Node, error)
+	dec = func(j *jsonNode) (*Node, error) {
+		if j == nil {
+			return nil, nil // reported by Validate
+		}
+		if j.Channel == "" {
+			n := &Node{Index: j.Index}
+			if j.Color != nil {
+				n.Color = j.Color.rgba64()
+			}
+			return n, nil
+		}
+		n := &Node{Split: j.Split}
+		for typ, ch := range jsonChannel {
+			if ch == j.Channel {
+				n.Type = typ
+			}
+		}
+		if n.Type == TLeaf {
+			return nil, fmt.Errorf("quant: invalid channel %q", j.Channel)
+		}
+		var err error
+		if n.Low, err = dec(j.Low); err != nil {
+			return nil, err
+		}
+		if n.High, err = dec(j.High); err != nil {
+			return nil, err
+		}
+		return n, nil
+	}
+	root, err := dec(j.Root)
+	if err != nil {
+		return err
+	}
+	d := TreePalette{Leaves: j.Leaves, Root: root}
+	if err := d.Validate(); err != nil {
+		return err
+	}
+	*t = d
+	return nil
+}
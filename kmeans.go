@@ -0,0 +1,166 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package quant
+
+import (
+	"image"
+	"image/color"
+
+	"github.com/soniakeys/quant/internal"
+)
+
+// KMeans refines palette p by k-means clustering of the pixels of img.
+//
+// Each iteration assigns each pixel to the nearest palette color, then moves
+// each palette color to the mean of its assigned pixels.  Iteration stops
+// after the given number of iterations or when no palette color moves.
+//
+// Colors with indices listed in frozen are never moved, although pixels
+// are still assigned to them.  Use this to keep reserved colors exact.
+// Colors with no pixels assigned are also left unchanged.  An empty
+// palette is returned unchanged.
+func KMeans(img image.Image, p Palette, iterations int, frozen []int) LinearPalette {
+	cp := p.ColorPalette()
+	if len(cp) == 0 {
+		return LinearPalette{Palette: cp}
+	}
+	fz := make([]bool, len(cp))
+	for _, i := range frozen {
+		if i >= 0 && i < len(cp) {
+			fz[i] = true
+		}
+	}
+	sp := newSPalette(cp)
+	px := sPixels(img)
+	for i := 0; i < iterations && sp.kmeansStep(px, fz); i++ {
+	}
+	out := make(color.Palette, len(cp))
+	copy(out, cp)
+	sp0 := newSPalette(cp)
+	for i, c := range sp {
+		if c != sp0[i] {
+			out[i] = color.RGBA64{uint16(c.r), uint16(c.g), uint16(c.b), 0xffff}
+		}
+	}
+	return LinearPalette{Palette: out}
+}
+
+// sPixels returns the pixel colors of img.
+func sPixels(img image.Image) []sRGB {
+	pxRGBA := internal.PxRGBAfunc(img)
+	b := img.Bounds()
+	px := make([]sRGB, 0, b.Dx()*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, b, _ := pxRGBA(x, y)
+			px = append(px, sRGB{int32(r), int32(g), int32(b)})
+		}
+	}
+	return px
+}
+
+// kmeansStep does one k-means iteration, assigning pixels px to palette
+// colors then moving palette colors not marked frozen to centroids.
+// It returns true if any palette color moved.
+func (p sPalette) kmeansStep(px []sRGB, frozen []bool) bool {
+	n := make([]int64, len(p))
+	sum := make([][3]int64, len(p))
+	for _, c := range px {
+		i := p.index(c)
+		n[i]++
+		sum[i][0] += int64(c.r)
+		sum[i][1] += int64(c.g)
+		sum[i][2] += int64(c.b)
+	}
+	moved := false
+	for i, ni := range n {
+		if ni == 0 || frozen[i] {
+			continue
+		}
+		c := sRGB{
+			int32(sum[i][0] / ni),
+			int32(sum[i][1] / ni),
+			int32(sum[i][2] / ni),
+		}
+		if c != p[i] {
+			p[i] = c
+			moved = true
+		}
+	}
+	return moved
+}
+
+// OptimalPalette returns a palette of up to n colors for img by k-means
+// clustering, as a near optimal baseline for comparing quantizers.
+//
+// Each of restarts runs seeds palette colors by k-means++, choosing pixels
+// as initial colors with probability proportional to squared distance from
+// colors already chosen, then iterates k-means to convergence.  The palette
+// with the least total squared error is returned.  Seeding is pseudo-random
+// but deterministic.  Fewer than n colors are returned if img has fewer
+// than n distinct colors.
+//
+// Cost is proportional to pixels * n * iterations * restarts, so this is
+// practical only for small images.
+func OptimalPalette(img image.Image, n, restarts int) LinearPalette {
+	px := sPixels(img)
+	if len(px) == 0 || n < 1 {
+		return LinearPalette{}
+	}
+	if restarts < 1 {
+		restarts = 1
+	}
+	var best sPalette
+	var bestErr int64
+	for r := 0; r < restarts; r++ {
+		sp := kmeansPP(px, n, uint64(r))
+		fz := make([]bool, len(sp))
+		for i := 0; i < 1000 && sp.kmeansStep(px, fz); i++ {
+		}
+		var e int64
+		for _, c := range px {
+			e += c.dist(sp[sp.index(c)])
+		}
+		if best == nil || e < bestErr {
+			best, bestErr = sp, e
+		}
+	}
+	cp := make(color.Palette, len(best))
+	for i, c := range best {
+		cp[i] = color.RGBA64{uint16(c.r), uint16(c.g), uint16(c.b), 0xffff}
+	}
+	return LinearPalette{Palette: cp}
+}
+
+// kmeansPP chooses up to n initial colors from px by k-means++ seeding,
+// with pseudo-random choices determined by seed.
+func kmeansPP(px []sRGB, n int, seed uint64) sPalette {
+	sp := sPalette{px[hash(seed, 0, 0)%uint64(len(px))]}
+	d := make([]int64, len(px)) // squared distance to nearest chosen color
+	for i, c := range px {
+		d[i] = c.dist(sp[0])
+	}
+	for k := 1; k < n; k++ {
+		var total int64
+		for _, di := range d {
+			total += di
+		}
+		if total == 0 {
+			break // all pixels are chosen colors
+		}
+		t := int64(hash(seed, uint64(k), 0) % uint64(total))
+		i := 0
+		for ; t >= d[i]; i++ {
+			t -= d[i]
+		}
+		c := px[i]
+		sp = append(sp, c)
+		for i, p := range px {
+			if s := p.dist(c); s < d[i] {
+				d[i] = s
+			}
+		}
+	}
+	return sp
+}
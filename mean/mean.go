@@ -23,6 +23,7 @@ import (
 	"image/color"
 	"image/draw"
 	"math"
+	"time"
 
 	"github.com/soniakeys/quant"
 	"github.com/soniakeys/quant/internal"
@@ -40,52 +41,253 @@ type Quantizer int
 var _ quant.Quantizer = Quantizer(0)
 var _ draw.Quantizer = Quantizer(0)
 
+func init() {
+	quant.Register("mean", func(n int) quant.Quantizer { return Quantizer(n) })
+}
+
 // Paletted performs color quantization and returns a paletted image.
 //
 // Returned is a new image.Paletted with no more than q colors.  Note though
 // that image.Paletted is limited to 256 colors.
 func (q Quantizer) Paletted(img image.Image) *image.Paletted {
-	n := int(q)
+	return Config{N: int(q)}.Paletted(img)
+}
+
+// Palette performs color quantization and returns a quant.Palette object.
+//
+// Returned is a palette with no more than q colors.  Q may be > 256.
+func (q Quantizer) Palette(img image.Image) quant.Palette {
+	return Config{N: int(q)}.Palette(img)
+}
+
+// Quantize performs color quantization and returns a color.Palette.
+//
+// Following the behavior documented with the draw.Quantizer interface,
+// "Quantize appends up to cap(p) - len(p) colors to p and returns the
+// updated palette...."  This method does not limit the number of colors
+// to 256.  Cap(p) or the quantity cap(p) - len(p) may be > 256.
+// Also for this method the value of the Quantizer object is ignored.
+func (q Quantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+	return Config{N: int(q)}.Quantize(p, m)
+}
+
+// Config is a Quantizer with options.
+//
+// N is the target number of colors, as with the value of a Quantizer.
+// The zero value of each other field selects the behavior of Quantizer,
+// so Config{N: n} quantizes exactly as Quantizer(n) does.
+//
+// Like Quantizer, Config satisfies both quant.Quantizer and draw.Quantizer.
+type Config struct {
+	N int
+
+	// SkinTone, if enabled, boosts split priority of clusters containing
+	// skin tone pixels.
+	SkinTone SkinTone
+
+	// BalanceTies, if true, divides pixels equal to the cut value between
+	// the two new clusters so that the clusters are as nearly equal in size
+	// as possible.  By default all pixels equal to the cut value go to one
+	// cluster, which can leave clusters lopsided when many pixels share the
+	// value.  Note that with BalanceTies pixels of the same color may be
+	// represented by different palette colors.
+	BalanceTies bool
+
+	// Crossover is the fraction of N colors after which clusters are
+	// prioritized for splitting by the product of population and color
+	// volume rather than by population alone.  Before the crossover,
+	// clusters are also split in the middle of the longer tail of their
+	// distribution rather than at the mean.  Zero means the default of
+	// 0.5.  A negative value crosses over at the start, a value of 1 or
+	// more never.
+	Crossover float64
+
+	// VolumeExponent is the exponent of color volume in the priority of
+	// clusters after Crossover, weighting volume more or less relative to
+	// population.  Zero means the default of 1.
+	VolumeExponent float64
+
+	// Exhaustive, if true, continues splitting clusters with color
+	// variation even when their split priority, an integer, is zero, so
+	// that N colors are reached up to the number of distinct colors in the
+	// image.  By default splitting stops when no cluster has a positive
+	// priority, which can give fewer than N colors, notably for tiny images.
+	Exhaustive bool
+
+	// Budget, if > 0, limits the time spent splitting clusters.  When the
+	// budget is exceeded splitting stops and the palette is built from the
+	// clusters so far, so it may have fewer than N colors.  Results then
+	// depend on machine speed and load.
+	Budget time.Duration
+
+	// ColorModel, if not nil, converts palette colors, for example to
+	// color.NRGBAModel so that alpha semantics are explicit for encoders.
+	// By default palette colors are color.RGBA.
+	ColorModel color.Model
+
+	// Canonical, if true, orders palettes returned by Paletted, Palette,
+	// and Quantize canonically, by quant.OrderCanonical, with image indexes
+	// remapped accordingly.  Identical color sets then always have the
+	// same order regardless of the order of splits, for diffing or caching
+	// of results.
+	Canonical bool
+
+	// Timing, if not nil, collects time spent in the scan, cut, and split
+	// phases of clustering.  Times are added to the fields of Timing.
+	Timing *quant.Timing
+}
+
+var _ quant.Quantizer = Config{}
+var _ draw.Quantizer = Config{}
+
+// Paletted performs color quantization and returns a paletted image.
+//
+// Returned is a new image.Paletted with no more than cf.N colors.  Note
+// though that image.Paletted is limited to 256 colors.
+func (cf Config) Paletted(img image.Image) *image.Paletted {
+	n := cf.N
 	if n > 256 {
 		n = 256
 	}
-	qz := newQuantizer(img, n)
+	qz := newQuantizer(img, n, &cf)
 	if n > 1 {
 		qz.cluster() // cluster pixels by color
 	}
-	return qz.paletted() // generate paletted image from clusters
+	pi := qz.paletted() // generate paletted image from clusters
+	if cf.Canonical {
+		p, remap := quant.OrderCanonical(quant.LinearPalette{Palette: pi.Palette})
+		quant.Reindex(pi, p, remap)
+	}
+	return pi
 }
 
 // Palette performs color quantization and returns a quant.Palette object.
 //
-// Returned is a palette with no more than q colors.  Q may be > 256.
-func (q Quantizer) Palette(img image.Image) quant.Palette {
-	qz := newQuantizer(img, int(q))
-	if q > 1 {
+// Returned is a palette with no more than cf.N colors.  N may be > 256.
+func (cf Config) Palette(img image.Image) quant.Palette {
+	qz := newQuantizer(img, cf.N, &cf)
+	if cf.N > 1 {
 		qz.cluster() // cluster pixels by color
 	}
-	return qz.palette()
+	return cf.canonical(qz.palette())
+}
+
+// canonical returns p reordered canonically if cf.Canonical is set.
+func (cf Config) canonical(p quant.Palette) quant.Palette {
+	if cf.Canonical {
+		p, _ = quant.OrderCanonical(p)
+	}
+	return p
 }
 
 // Quantize performs color quantization and returns a color.Palette.
 //
-// Following the behavior documented with the draw.Quantizer interface,
-// "Quantize appends up to cap(p) - len(p) colors to p and returns the
-// updated palette...."  This method does not limit the number of colors
-// to 256.  Cap(p) or the quantity cap(p) - len(p) may be > 256.
-// Also for this method the value of the Quantizer object is ignored.
-func (Quantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+// As with Quantizer.Quantize, the number of colors is determined by p and
+// cf.N is ignored.  Other options of cf are used.
+func (cf Config) Quantize(p color.Palette, m image.Image) color.Palette {
 	n := cap(p) - len(p)
-	qz := newQuantizer(m, n)
+	qz := newQuantizer(m, n, &cf)
 	if n > 1 {
 		qz.cluster() // cluster pixels by color
 	}
-	return p[:len(p)+copy(p[len(p):cap(p)], qz.palette().ColorPalette())]
+	return p[:len(p)+copy(p[len(p):cap(p)], cf.canonical(qz.palette()).ColorPalette())]
+}
+
+// Gamuts performs color quantization and returns the gamut, or RGB bounding
+// box, of the pixels represented by each palette color.
+//
+// Gamuts are indexed as the palette returned by Palette.
+func (q Quantizer) Gamuts(img image.Image) []quant.Gamut {
+	return Config{N: int(q)}.Gamuts(img)
+}
+
+// Gamuts performs color quantization and returns the gamut, or RGB bounding
+// box, of the pixels represented by each palette color.
+//
+// Gamuts are indexed as the palette returned by Palette.
+func (cf Config) Gamuts(img image.Image) []quant.Gamut {
+	qz := newQuantizer(img, cf.N, &cf)
+	if len(qz.cs) == 0 {
+		return nil
+	}
+	if cf.N > 1 {
+		qz.cluster() // cluster pixels by color
+	}
+	g := make([]quant.Gamut, len(qz.cs))
+	for i := range qz.cs {
+		c := &qz.cs[i]
+		qz.setPriority(c, false) // (re)compute extents
+		g[i] = c.gamut
+	}
+	return g
+}
+
+// TreePalette performs color quantization and returns a quant.TreePalette
+// representing the splits made in clustering.
+//
+// Palette colors are the same as those returned by Palette, but indexed in
+// tree order, which may differ from the order of Palette.  Lookups with
+// IndexNear or ColorNear reproduce the clustering, so that ColorNear of
+// any pixel of img gives the palette color of the pixel in Paletted.
+// The exception is with option BalanceTies, where pixels with the cut
+// value may be in either cluster but are looked up in the upper one.
+func (q Quantizer) TreePalette(img image.Image) *quant.TreePalette {
+	return Config{N: int(q)}.TreePalette(img)
+}
+
+// TreePalette performs color quantization and returns a quant.TreePalette
+// representing the splits made in clustering.  See Quantizer.TreePalette.
+func (cf Config) TreePalette(img image.Image) *quant.TreePalette {
+	qz := newQuantizer(img, cf.N, &cf)
+	if len(qz.cs) == 0 {
+		return &quant.TreePalette{}
+	}
+	if cf.N > 1 {
+		qz.cluster() // cluster pixels by color
+	}
+	cp := qz.palette().ColorPalette()
+	for i := range qz.cs {
+		r, g, b, a := cp[i].RGBA()
+		qz.cs[i].node.Color = color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)}
+	}
+	qz.t.Leaves = len(qz.cs)
+	qz.t.Walk(func(leaf *quant.Node, i int) { leaf.Index = i })
+	return &qz.t
+}
+
+// SkinTone specifies a region of YCbCr color space considered to be skin
+// tones and a boost factor for split priority of clusters containing such
+// colors.
+//
+// Bounds are inclusive and in the 8 bit units of color.YCbCr.  Luma is not
+// considered.  Pixels with Cb and Cr within the bounds count Boost times
+// rather than once when computing cluster priority, giving skin tones
+// proportionally more palette entries.  A Boost of 0 or 1 disables the
+// feature, so the zero value is off.
+type SkinTone struct {
+	CbMin, CbMax uint8
+	CrMin, CrMax uint8
+	Boost        int
+}
+
+// DefaultSkinTone is a commonly used skin tone region, with a moderate boost.
+var DefaultSkinTone = SkinTone{
+	CbMin: 77, CbMax: 127,
+	CrMin: 133, CrMax: 173,
+	Boost: 4,
+}
+
+// contains reports whether 16 bit RGB values are within the skin tone region.
+func (st *SkinTone) contains(r, g, b uint32) bool {
+	_, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+	return cb >= st.CbMin && cb <= st.CbMax && cr >= st.CrMin && cr <= st.CrMax
 }
 
 type quantizer struct {
-	img image.Image // original image
-	cs  []cluster   // len(cs) is the desired number of colors
+	img image.Image       // original image
+	cs  []cluster         // len(cs) is the desired number of colors
+	cf  *Config           // options
+	t   quant.TreePalette // tree of splits
 
 	pxRGBA func(x, y int) (r, g, b, a uint32) // function to get original image RGBA color values
 }
@@ -96,24 +298,30 @@ type cluster struct {
 	px []point // list of points in the cluster
 	// rgb const identifying dimension in color space with widest range
 	widestDim int
-	min, max  uint32 // min, max color values in dimension with widest range
-	volume    uint64 // color volume
-	priority  int    // early: population, late: population*volume
+	min, max  uint32      // min, max color values in dimension with widest range
+	volume    uint64      // color volume
+	priority  int         // early: population, late: population*volume
+	gamut     quant.Gamut // extents of colors
+	node      *quant.Node // tree node representing this cluster
 }
 
 // indentifiers for RGB channels, or dimensions or axes of RGB color space
 const (
-	rgbR = iota
-	rgbG
-	rgbB
+	rgbR = quant.AxisR
+	rgbG = quant.AxisG
+	rgbB = quant.AxisB
 )
 
-func newQuantizer(img image.Image, n int) *quantizer {
+func newQuantizer(img image.Image, n int, cf *Config) *quantizer {
 	if n < 1 {
-		return &quantizer{img: img, pxRGBA: internal.PxRGBAfunc(img)}
+		return &quantizer{img: img, cf: cf, pxRGBA: internal.PxRGBAfunc(img)}
 	}
 	// Make list of all pixels in image.
 	b := img.Bounds()
+	if b.Empty() {
+		// no pixels, no clusters
+		return &quantizer{img: img, cf: cf, pxRGBA: internal.PxRGBAfunc(img)}
+	}
 	px := make([]point, (b.Max.X-b.Min.X)*(b.Max.Y-b.Min.Y))
 	i := 0
 	for y := b.Min.Y; y < b.Max.Y; y++ {
@@ -126,7 +334,14 @@ func newQuantizer(img image.Image, n int) *quantizer {
 	// Make clusters, populate first cluster with complete pixel list.
 	cs := make([]cluster, n)
 	cs[0].px = px
-	return &quantizer{img: img, cs: cs, pxRGBA: internal.PxRGBAfunc(img)}
+	cs[0].node = &quant.Node{}
+	return &quantizer{
+		img:    img,
+		cs:     cs,
+		cf:     cf,
+		t:      quant.TreePalette{Root: cs[0].node},
+		pxRGBA: internal.CachedPxRGBAfunc(img),
+	}
 }
 
 // Cluster by repeatedly splitting clusters in two stages.  For the first
@@ -136,21 +351,41 @@ func newQuantizer(img image.Image, n int) *quantizer {
 // values in the dimension with widest range.  Terminate when the desired number
 // of clusters has been populated or when clusters cannot be further split.
 func (qz *quantizer) cluster() {
+	if len(qz.cs) == 0 {
+		return // no pixels
+	}
+	var deadline time.Time
+	if qz.cf.Budget > 0 {
+		deadline = time.Now().Add(qz.cf.Budget)
+	}
 	cs := qz.cs
+	// index of the first cluster after crossover.  the name is from the
+	// default crossover of 0.5.
 	half := len(cs) / 2
+	switch x := qz.cf.Crossover; {
+	case x < 0:
+		half = 0
+	case x > 0:
+		half = int(math.Min(x, 1) * float64(len(cs)))
+	}
 	// cx is index of new cluster, populated at start of loop here, but
 	// not yet analyzed.
 	cx := 0
 	c := &cs[cx]
 	for {
-		qz.setPriority(c, cx < half) // compute statistics for new cluster
+		if c != nil {
+			qz.scan(c, cx < half) // compute statistics for new cluster
+		}
 		// determine cluster to split, sx
 		sx := -1
 		var maxP int
 		for x := 0; x <= cx; x++ {
-			// rule is to consider only clusters with non-zero color volume
-			// and then split cluster with highest priority.
-			if c := &cs[x]; c.max > c.min && c.priority > maxP {
+			// rule is to consider only clusters with color variation and
+			// then split cluster with highest priority.  priority may be
+			// zero for small clusters or those with zero volume.  these
+			// are split only if Exhaustive.
+			if c := &cs[x]; c.max > c.min &&
+				(c.priority > maxP || sx < 0 && qz.cf.Exhaustive) {
 				maxP = c.priority
 				sx = x
 			}
@@ -162,25 +397,78 @@ func (qz *quantizer) cluster() {
 			break
 		}
 		s := &cs[sx]
+		t0 := qz.start()
 		m := qz.cutValue(s, cx < half) // get where to split cluster
-		// point to next cluster to populate
+		qz.stop(cutPhase, t0)
+		// populate next cluster by splitting s into it and s at value m
+		t0 = qz.start()
+		ok := qz.split(s, &cs[cx+1], m)
+		qz.stop(splitPhase, t0)
+		if !ok {
+			// s has no variation after all.  exclude it from splitting
+			// and pick again without populating a new cluster.
+			s.max = s.min
+			c = nil
+			continue
+		}
 		cx++
 		c = &cs[cx]
-		// populate c by splitting s into c and s at value m
-		qz.split(s, c, m)
 		// Normal exit is when all clusters are populated.
 		if cx == len(cs)-1 {
 			break
 		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			qz.cs = qz.cs[:cx+1]
+			break
+		}
 		if cx == half {
 			// change priorities on existing clusters
 			for x := 0; x < cx; x++ {
-				cs[x].priority =
-					int(uint64(cs[x].priority) * (cs[x].volume >> 16) >> 29)
+				cs[x].priority = qz.late(cs[x].priority, cs[x].volume)
 			}
 		}
-		qz.setPriority(s, cx < half) // set priority for newly split s
+		qz.scan(s, cx < half) // set priority for newly split s
+	}
+}
+
+// Phases of clustering timed by Config.Timing.
+const (
+	scanPhase = iota
+	cutPhase
+	splitPhase
+)
+
+// start returns the start time of a phase timed by Config.Timing, or the
+// zero time if Timing is nil.
+func (qz *quantizer) start() time.Time {
+	if qz.cf.Timing == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// stop adds the time since t0 to the phase of Config.Timing.
+func (qz *quantizer) stop(phase int, t0 time.Time) {
+	t := qz.cf.Timing
+	if t == nil {
+		return
 	}
+	d := time.Since(t0)
+	switch phase {
+	case scanPhase:
+		t.Scan += d
+	case cutPhase:
+		t.Cut += d
+	default:
+		t.Split += d
+	}
+}
+
+// scan is setPriority, timed as a scan phase.
+func (qz *quantizer) scan(c *cluster, early bool) {
+	t0 := qz.start()
+	qz.setPriority(c, early)
+	qz.stop(scanPhase, t0)
 }
 
 func (q *quantizer) setPriority(c *cluster, early bool) {
@@ -189,8 +477,13 @@ func (q *quantizer) setPriority(c *cluster, early bool) {
 	minR := uint32(math.MaxUint32)
 	minG := uint32(math.MaxUint32)
 	minB := uint32(math.MaxUint32)
+	st := &q.cf.SkinTone
+	skin := 0 // count of skin tone pixels
 	for _, p := range c.px {
 		r, g, b, _ := q.pxRGBA(int(p.x), int(p.y))
+		if st.Boost > 1 && st.contains(r, g, b) {
+			skin++
+		}
 		if r < minR {
 			minR = r
 		}
@@ -225,14 +518,33 @@ func (q *quantizer) setPriority(c *cluster, early bool) {
 		max = maxB
 	}
 	// store statistics
+	c.gamut = quant.Gamut{
+		Min: color.RGBA64{uint16(minR), uint16(minG), uint16(minB), 0xffff},
+		Max: color.RGBA64{uint16(maxR), uint16(maxG), uint16(maxB), 0xffff},
+	}
 	c.widestDim = w
 	c.min = min
 	c.max = max
 	c.volume = uint64(maxR-minR) * uint64(maxG-minG) * uint64(maxB-minB)
-	c.priority = len(c.px)
+	c.priority = len(c.px) + skin*(st.Boost-1)
 	if !early {
-		c.priority = int(uint64(c.priority) * (c.volume >> 16) >> 29)
+		c.priority = q.late(c.priority, c.volume)
+	}
+}
+
+// late returns the priority after crossover for early priority p and color
+// volume v.
+func (q *quantizer) late(p int, v uint64) int {
+	e := q.cf.VolumeExponent
+	if e == 0 || e == 1 {
+		return int(uint64(p) * (v >> 16) >> 29)
 	}
+	// same scale as above, p * v/2^48 * 8
+	f := float64(p) * math.Pow(float64(v)/(1<<48), e) * 8
+	if f > math.MaxInt32 {
+		f = math.MaxInt32
+	}
+	return int(f)
 }
 
 func (q *quantizer) cutValue(c *cluster, early bool) uint32 {
@@ -266,7 +578,10 @@ func (q *quantizer) cutValue(c *cluster, early bool) uint32 {
 	return mean
 }
 
-func (q *quantizer) split(s, c *cluster, m uint32) {
+// split splits cluster s at value m, moving points to c.  It returns false
+// and leaves s unchanged if either part would be empty, as can happen only
+// if s has no variation in its widest dimension.
+func (q *quantizer) split(s, c *cluster, m uint32) bool {
 	px := s.px
 	var v uint32
 	i := 0
@@ -283,16 +598,68 @@ func (q *quantizer) split(s, c *cluster, m uint32) {
 			v = b
 		}
 		// Split into two non-empty parts at m.
-		if v < m || m == s.min && v == m {
+		if v < m || m == s.min && v == m && !q.cf.BalanceTies {
 			i++
 		} else {
 			px[last], px[i] = px[i], px[last]
 			last--
 		}
 	}
+	if q.cf.BalanceTies && i < len(px) {
+		i = q.balanceTies(px, i, s.widestDim, m)
+	}
+	if i == 0 || i == len(px) {
+		return false
+	}
 	// Split the pixel list.
 	s.px = px[:i]
 	c.px = px[i:]
+	// Split the tree node.  The split value is the threshold actually used,
+	// so that tree lookups reproduce the clustering.
+	n := s.node
+	n.Type = [...]int{quant.TSplitR, quant.TSplitG, quant.TSplitB}[s.widestDim]
+	n.Split = m
+	if m == s.min && !q.cf.BalanceTies {
+		n.Split = m + 1 // v == m went low
+	}
+	n.Low = &quant.Node{}
+	n.High = &quant.Node{}
+	s.node, c.node = n.Low, n.High
+	return true
+}
+
+// balanceTies partitions px[i:], points with values >= m in dimension dim,
+// into points equal to m followed by points greater than m.  It returns
+// a cut index that divides the points equal to m to balance the sizes
+// of px[:cut] and px[cut:].  Both parts are non-empty.
+func (q *quantizer) balanceTies(px []point, i, dim int, m uint32) int {
+	j := i
+	last := len(px) - 1
+	for j <= last {
+		r, g, b, _ := q.pxRGBA(int(px[j].x), int(px[j].y))
+		v := b
+		switch dim {
+		case rgbR:
+			v = r
+		case rgbG:
+			v = g
+		}
+		if v == m {
+			j++
+		} else {
+			px[last], px[j] = px[j], px[last]
+			last--
+		}
+	}
+	// px[i:j] now holds ties.
+	cut := i
+	for cut < j && cut < len(px)/2 {
+		cut++
+	}
+	if cut == 0 {
+		cut = 1
+	}
+	return cut
 }
 
 func (qz *quantizer) paletted() *image.Paletted {
@@ -309,12 +676,12 @@ func (qz *quantizer) paletted() *image.Paletted {
 			bsum += int64(b)
 		}
 		n64 := int64(len(px) << 8)
-		cp[i] = color.RGBA{
+		cp[i] = qz.color(color.RGBA{
 			uint8(rsum / n64),
 			uint8(gsum / n64),
 			uint8(bsum / n64),
 			0xff,
-		}
+		})
 		// set image pixels
 		for _, p := range px {
 			pi.SetColorIndex(int(p.x), int(p.y), uint8(i))
@@ -323,6 +690,14 @@ func (qz *quantizer) paletted() *image.Paletted {
 	return pi
 }
 
+// color converts palette color c by Config.ColorModel.
+func (qz *quantizer) color(c color.RGBA) color.Color {
+	if qz.cf.ColorModel == nil {
+		return c
+	}
+	return qz.cf.ColorModel.Convert(c)
+}
+
 func (qz *quantizer) palette() quant.Palette {
 	cp := make(color.Palette, len(qz.cs))
 	for i := range qz.cs {
@@ -336,12 +711,12 @@ func (qz *quantizer) palette() quant.Palette {
 			bsum += int64(b)
 		}
 		n64 := int64(len(px) << 8)
-		cp[i] = color.RGBA{
+		cp[i] = qz.color(color.RGBA{
 			uint8(rsum / n64),
 			uint8(gsum / n64),
 			uint8(bsum / n64),
 			0xff,
-		}
+		})
 	}
-	return quant.LinearPalette{cp}
+	return quant.LinearPalette{Palette: cp}
 }
@@ -1,15 +1,22 @@
 package mean_test
 
 import (
+	"bytes"
+	"flag"
 	"fmt"
 	"image"
+	"image/color"
 	"image/png"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"testing"
+	"time"
 
 	"github.com/soniakeys/quant"
+	"github.com/soniakeys/quant/internal/testimage"
 	"github.com/soniakeys/quant/mean"
 )
 
@@ -89,3 +96,269 @@ func BenchmarkPalette(b *testing.B) {
 		q.Palette(img)
 	}
 }
+
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+// TestGolden quantizes a synthetic image generated in code and compares
+// the resulting palette and pixel indices with golden files in testdata.
+// Run with -update to regenerate the golden files after an intended change
+// in results.
+func TestGolden(t *testing.T) {
+	img := testimage.Synthetic()
+	for _, n := range []int{16, 256} {
+		got := golden(mean.Quantizer(n).Paletted(img))
+		fn := filepath.Join("testdata", fmt.Sprintf("synthetic_%d.golden", n))
+		if *update {
+			if err := ioutil.WriteFile(fn, got, 0666); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("n = %d: result differs from %s", n, fn)
+		}
+	}
+}
+
+// golden formats a paletted image as text, one line per palette color
+// followed by one line of hex indices per row of pixels.
+func golden(pi *image.Paletted) []byte {
+	var b bytes.Buffer
+	for _, c := range pi.Palette {
+		r, g, bl, a := c.RGBA()
+		fmt.Fprintf(&b, "%04x %04x %04x %04x\n", r, g, bl, a)
+	}
+	r := pi.Bounds()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		i := pi.PixOffset(r.Min.X, y)
+		fmt.Fprintf(&b, "%x\n", pi.Pix[i:i+r.Dx()])
+	}
+	return b.Bytes()
+}
+
+// TestTreePalette tests that tree lookups reproduce the clustering.
+func TestTreePalette(t *testing.T) {
+	img := testimage.Synthetic()
+	for _, n := range []int{16, 256} {
+		q := mean.Quantizer(n)
+		pi := q.Paletted(img)
+		tp := q.TreePalette(img)
+		if tp.Len() != len(pi.Palette) {
+			t.Fatalf("n = %d: tree has %d colors, want %d",
+				n, tp.Len(), len(pi.Palette))
+		}
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r0, g0, b0, a0 := pi.At(x, y).RGBA()
+				r, g, bl, a := tp.ColorNear(img.At(x, y)).RGBA()
+				if r != r0 || g != g0 || bl != b0 || a != a0 {
+					t.Fatalf("n = %d: pixel %d, %d maps to different color",
+						n, x, y)
+				}
+			}
+		}
+	}
+}
+
+func TestColorModel(t *testing.T) {
+	img := testimage.Synthetic()
+	want := mean.Quantizer(16).Paletted(img)
+	pi := mean.Config{N: 16, ColorModel: color.NRGBAModel}.Paletted(img)
+	if !bytes.Equal(pi.Pix, want.Pix) {
+		t.Fatal("pixels differ")
+	}
+	for i, c := range pi.Palette {
+		if _, ok := c.(color.NRGBA); !ok || c != color.NRGBAModel.Convert(want.Palette[i]) {
+			t.Fatalf("color %d = %#v", i, c)
+		}
+	}
+}
+
+func TestBudget(t *testing.T) {
+	img := testimage.Synthetic()
+	pi := mean.Config{N: 256, Budget: time.Nanosecond}.Paletted(img)
+	if len(pi.Palette) >= 256 {
+		t.Fatalf("%d colors", len(pi.Palette))
+	}
+}
+
+func TestTiming(t *testing.T) {
+	img := testimage.Synthetic()
+	var tm quant.Timing
+	pi := mean.Config{N: 256, Timing: &tm}.Paletted(img)
+	if tm.Scan <= 0 || tm.Cut <= 0 || tm.Split <= 0 {
+		t.Fatalf("%+v", tm)
+	}
+	// timing does not change results
+	if !reflect.DeepEqual(pi, mean.Quantizer(256).Paletted(img)) {
+		t.Fatal("result differs with Timing")
+	}
+}
+
+// countingImage counts calls to At by pixel.
+type countingImage struct {
+	image.Image
+	n map[image.Point]int
+}
+
+func (c *countingImage) At(x, y int) color.Color {
+	c.n[image.Pt(x, y)]++
+	return c.Image.At(x, y)
+}
+
+func TestAtOnce(t *testing.T) {
+	src := testimage.Synthetic()
+	q := mean.Quantizer(16)
+	for _, f := range []func(image.Image){
+		func(img image.Image) { q.Paletted(img) },
+		func(img image.Image) { q.Palette(img) },
+	} {
+		img := &countingImage{src, map[image.Point]int{}}
+		f(img)
+		for y := src.Rect.Min.Y; y < src.Rect.Max.Y; y++ {
+			for x := src.Rect.Min.X; x < src.Rect.Max.X; x++ {
+				if n := img.n[image.Pt(x, y)]; n != 1 {
+					t.Fatalf("At(%d, %d) called %d times", x, y, n)
+				}
+			}
+		}
+	}
+	// results are as with the image read directly
+	if !reflect.DeepEqual(q.Paletted(&countingImage{src, map[image.Point]int{}}),
+		q.Paletted(src)) {
+		t.Fatal("results differ")
+	}
+}
+
+func TestCrossover(t *testing.T) {
+	img := testimage.Synthetic()
+	def := mean.Quantizer(64).Paletted(img)
+	if !reflect.DeepEqual(mean.Config{N: 64, Crossover: .5, VolumeExponent: 1}.Paletted(img), def) {
+		t.Fatal("explicit defaults differ from default")
+	}
+	for _, cf := range []mean.Config{
+		{N: 64, Crossover: -1},
+		{N: 64, Crossover: .25},
+		{N: 64, Crossover: 1},
+		{N: 64, VolumeExponent: .5},
+		{N: 64, VolumeExponent: 2},
+	} {
+		pi := cf.Paletted(img)
+		if len(pi.Palette) < 32 || len(pi.Palette) > 64 {
+			t.Fatalf("%+v: %d colors", cf, len(pi.Palette))
+		}
+		if reflect.DeepEqual(pi, def) {
+			t.Fatalf("%+v: same as default", cf)
+		}
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	img := testimage.Synthetic()
+	cf := mean.Config{N: 16, Canonical: true}
+	pi := cf.Paletted(img)
+	want, _ := quant.OrderCanonical(mean.Quantizer(16).Palette(img))
+	if !reflect.DeepEqual(pi.Palette, want.Palette) {
+		t.Fatal("Paletted palette not canonical")
+	}
+	orig := mean.Quantizer(16).Paletted(img)
+	for i := range pi.Pix {
+		if pi.Palette[pi.Pix[i]] != orig.Palette[orig.Pix[i]] {
+			t.Fatalf("pixel %d changed color", i)
+		}
+	}
+	if p := cf.Palette(img); !reflect.DeepEqual(p.ColorPalette(), want.Palette) {
+		t.Fatal("Palette not canonical")
+	}
+}
+
+func TestSkinTone(t *testing.T) {
+	// a large blue to green field with a small patch of skin tones
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetRGBA(x, y, color.RGBA{0, uint8(x * 4), uint8(255 - y*4), 255})
+		}
+	}
+	for y := 0; y < 12; y++ {
+		for x := 0; x < 12; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(170 + x*6), uint8(120 + y*5), uint8(90 + x*3), 255})
+		}
+	}
+	skin := func(p quant.Palette) int {
+		n := 0
+		st := mean.DefaultSkinTone
+		for _, c := range p.ColorPalette() {
+			r, g, b, _ := c.RGBA()
+			_, cb, cr := color.RGBToYCbCr(uint8(r>>8), uint8(g>>8), uint8(b>>8))
+			if cb >= st.CbMin && cb <= st.CbMax && cr >= st.CrMin && cr <= st.CrMax {
+				n++
+			}
+		}
+		return n
+	}
+	plain := mean.Quantizer(16).Palette(img)
+	boosted := mean.Config{N: 16, SkinTone: mean.DefaultSkinTone}.Palette(img)
+	if skin(boosted) <= skin(plain) {
+		t.Fatalf("%d skin tone colors boosted, %d plain", skin(boosted), skin(plain))
+	}
+	// the zero value, and a Boost of 1, change nothing
+	for _, st := range []mean.SkinTone{{}, {CbMin: 77, CbMax: 127, CrMin: 133, CrMax: 173, Boost: 1}} {
+		if p := (mean.Config{N: 16, SkinTone: st}).Palette(img); !reflect.DeepEqual(p, plain) {
+			t.Fatalf("SkinTone %+v changed the palette", st)
+		}
+	}
+}
+
+func TestBalanceTies(t *testing.T) {
+	// 100 gray pixels: 10 dark, 80 mid gray, 10 light.  The distribution
+	// is symmetric so the mean is exactly the mid gray value.
+	img := image.NewGray(image.Rect(0, 0, 100, 1))
+	for x := range img.Pix {
+		switch {
+		case x < 10:
+			img.Pix[x] = 64
+		case x < 90:
+			img.Pix[x] = 128
+		default:
+			img.Pix[x] = 192
+		}
+	}
+	sizes := func(pi *image.Paletted) (n [2]int) {
+		for _, x := range pi.Pix {
+			n[x]++
+		}
+		return
+	}
+	// a negative Crossover cuts at the mean from the start
+	cf := mean.Config{N: 2, Crossover: -1}
+	if n := sizes(cf.Paletted(img)); n != [2]int{10, 90} {
+		t.Errorf("default: cluster sizes %v, want [10 90]", n)
+	}
+	cf.BalanceTies = true
+	if n := sizes(cf.Paletted(img)); n != [2]int{50, 50} {
+		t.Errorf("BalanceTies: cluster sizes %v, want [50 50]", n)
+	}
+}
+
+func TestTinyImages(t *testing.T) {
+	testimage.TinyImages(t, func(n int) testimage.Quantizer {
+		return mean.Config{N: n, Exhaustive: true}
+	})
+}
+
+func TestExhaustive(t *testing.T) {
+	img := testimage.Synthetic()
+	// by default splitting stops short of 256 colors
+	if n := len(mean.Quantizer(256).Paletted(img).Palette); n >= 256 {
+		t.Fatalf("default gave %d colors", n)
+	}
+	if n := len(mean.Config{N: 256, Exhaustive: true}.Paletted(img).Palette); n != 256 {
+		t.Fatalf("Exhaustive gave %d colors, want 256", n)
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package mean
+
+import (
+	"image"
+	"testing"
+)
+
+// TestSplitDegenerate calls split on a cluster with no color variation,
+// which cluster should never do, and checks that no empty cluster results.
+func TestSplitDegenerate(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := range img.Pix {
+		img.Pix[i] = 0x80
+	}
+	for _, bt := range []bool{false, true} {
+		for _, dm := range []int{-1, 0, 1} {
+			qz := newQuantizer(img, 2, &Config{N: 2, BalanceTies: bt})
+			s, c := &qz.cs[0], &qz.cs[1]
+			qz.setPriority(s, true)
+			m := uint32(int(s.min) + dm)
+			if qz.split(s, c, m) {
+				if len(s.px) == 0 || len(c.px) == 0 {
+					t.Fatalf("BalanceTies %t, m %d: empty cluster", bt, m)
+				}
+				continue
+			}
+			if len(s.px) != 16 || len(c.px) != 0 || s.node.Type != 0 {
+				t.Fatalf("BalanceTies %t, m %d: s modified", bt, m)
+			}
+		}
+	}
+}
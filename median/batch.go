@@ -0,0 +1,69 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package median
+
+import (
+	"image"
+	"image/color"
+
+	"github.com/soniakeys/quant"
+	"github.com/soniakeys/quant/internal"
+)
+
+// Batch quantizes frames to one shared palette of no more than q colors
+// with transparent color at index 0.  See Config.Batch.
+func (q Quantizer) Batch(frames []image.Image, transparent color.Color) ([]*image.Paletted, quant.Palette) {
+	return Config{N: int(q)}.Batch(frames, transparent)
+}
+
+// Batch quantizes frames, such as of a sprite sheet, to one shared palette
+// of no more than cf.N colors, at most 256, with color transparent pinned
+// at index 0.  Values of cf.N less than 2 are taken as 2, so that there is
+// always at least one opaque color.
+//
+// Pixels of the transparent color or with alpha 0 are transparent.  They
+// are excluded from palette derivation and mapped to index 0.  Remaining
+// colors are derived from a histogram of the other pixels of all frames
+// and these pixels are mapped to the nearest derived color.  Options of cf
+// are used as with QuantizeHistogram.
+//
+// Returned are the paletted frames, in the order of frames, and the shared
+// palette.
+func (cf Config) Batch(frames []image.Image, transparent color.Color) ([]*image.Paletted, quant.Palette) {
+	switch {
+	case cf.N > 256:
+		cf.N = 256
+	case cf.N < 2:
+		cf.N = 2
+	}
+	tr, tg, tb, ta := transparent.RGBA()
+	isTransparent := func(r, g, b, a uint32) bool {
+		return a == 0 || r == tr && g == tg && b == tb && a == ta
+	}
+	var t tally
+	for _, f := range frames {
+		t.add(f, isTransparent)
+	}
+	cf.N--
+	p := cf.QuantizeHistogram(t.colors, t.counts)
+	cp := append(color.Palette{transparent}, p.ColorPalette()...)
+	pis := make([]*image.Paletted, len(frames))
+	for i, f := range frames {
+		b := f.Bounds()
+		pxRGBA := internal.PxRGBAfunc(f)
+		pi := image.NewPaletted(b, cp)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r, g, bl, a := pxRGBA(x, y)
+				if isTransparent(r, g, bl, a) {
+					continue // index 0
+				}
+				c := color.RGBA64{uint16(r), uint16(g), uint16(bl), uint16(a)}
+				pi.SetColorIndex(x, y, uint8(1+p.IndexNear(c)))
+			}
+		}
+		pis[i] = pi
+	}
+	return pis, quant.LinearPalette{Palette: cp}
+}
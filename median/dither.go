@@ -0,0 +1,89 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package median
+
+import (
+	"image"
+	"math"
+
+	"github.com/soniakeys/quant"
+)
+
+// SelectiveDither performs color quantization and returns a paletted image
+// dithered only where clusters have high color variance.  See
+// Config.SelectiveDither.
+func (q Quantizer) SelectiveDither(img image.Image, d quant.Sierra24A, flat float64) *image.Paletted {
+	return Config{N: int(q)}.SelectiveDither(img, d, flat)
+}
+
+// SelectiveDither performs color quantization and returns a paletted image
+// dithered only where clusters have high color variance.
+//
+// For images mixing flat fills with photographic regions, dithering helps
+// the gradients of the photographic regions but only adds noise to flat
+// areas.  Here pixels of clusters with an RMS color difference from the
+// cluster color of no more than flat, in 16 bit color units, are mapped to
+// the cluster color without dithering.  Pixels of other clusters are
+// dithered with d.  Flat area pixels neither receive nor diffuse error.
+// A flat value around 0x800 is a reasonable start.
+//
+// As with Paletted, the number of colors is limited to 256.  With options
+// that map pixels by other than cluster, ToWorking, AlphaThreshold,
+// ChromaKey, Gray, Ramps, TwoPass, and InverseFrequency, all pixels are
+// dithered.
+func (cf Config) SelectiveDither(img image.Image, d quant.Sierra24A, flat float64) *image.Paletted {
+	img = cf.composite(img)
+	if cf.N > 256 {
+		cf.N = 256
+	}
+	if cf.ToWorking != nil || cf.reserved() {
+		pi := cf.paletted(img)
+		return cf.model(d.DitherFixed(img, pi.Palette, nil))
+	}
+	if p, ok := cf.altPalette(img); ok {
+		return cf.model(d.DitherFixed(img, p.ColorPalette(), nil))
+	}
+	qz := cf.quantize(img)
+	b := img.Bounds()
+	// fixed index by point, or -1
+	fixed := make([]int, b.Dx()*b.Dy())
+	for i := range fixed {
+		fixed[i] = -1
+	}
+	for i := range qz.cs {
+		c := &qz.cs[i]
+		if qz.rms(c) > flat {
+			continue
+		}
+		for _, p := range c.px {
+			fixed[p] = c.node.Index
+		}
+	}
+	w := b.Dx()
+	pi := d.DitherFixed(img, qz.palette().ColorPalette(), func(x, y int) int {
+		return fixed[(y-b.Min.Y)*w+x-b.Min.X]
+	})
+	return cf.model(pi)
+}
+
+// rms returns the root mean square color difference of pixels of cluster
+// c from the cluster color.
+func (qz *quantizer) rms(c *cluster) float64 {
+	cr, cg, cb, _ := c.node.Color.RGBA()
+	var sum float64
+	n := 0
+	for _, p := range c.px {
+		r, g, b, _ := qz.pxRGBA(int(p))
+		dr := float64(r) - float64(cr)
+		dg := float64(g) - float64(cg)
+		db := float64(b) - float64(cb)
+		w := qz.weight(p)
+		sum += float64(w) * (dr*dr + dg*dg + db*db)
+		n += w
+	}
+	if n == 0 {
+		return 0
+	}
+	return math.Sqrt(sum / float64(n))
+}
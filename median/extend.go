@@ -0,0 +1,86 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package median
+
+import (
+	"image"
+	"image/color"
+
+	"github.com/soniakeys/quant"
+)
+
+// Extend derives a palette of n colors extending palette prev with colors
+// from img.
+//
+// The colors of prev are kept unchanged at the same indexes so that images
+// already mapped to prev remain valid with the result.  New colors fill
+// the higher indexes.  See Config.Extend.  As with Quantize, the value of
+// q is ignored.
+func (q Quantizer) Extend(prev quant.Palette, img image.Image, n int) quant.Palette {
+	return Config{N: n}.Extend(prev, img)
+}
+
+// Extend derives a palette of cf.N colors extending palette prev with
+// colors from img.
+//
+// The colors of prev are kept unchanged at the same indexes so that images
+// already mapped to prev remain valid with the result.  New colors fill
+// the higher indexes.  They are derived by assigning pixels to the nearest
+// colors of prev, as with WarmStart, and splitting the resulting clusters
+// where prev represents the image poorly.  Of the clusters split from each
+// color of prev, the one nearest that color is represented by it and the
+// others add new colors.
+//
+// The result is a LinearPalette.  If cf.N is no more than the number of
+// colors of prev, the colors of prev are returned unchanged.  The result
+// may have fewer than cf.N colors if img has few colors.  Options that
+// change the mapping of pixels, AlphaThreshold, ChromaKey, Gray, Ramps,
+// TwoPass, InverseFrequency, ToWorking, and WarmStart, are ignored.
+func (cf Config) Extend(prev quant.Palette, img image.Image) quant.Palette {
+	img = cf.composite(img)
+	cp := prev.ColorPalette()
+	out := append(color.Palette{}, cp...)
+	k := len(cp)
+	if cf.N <= k {
+		return quant.LinearPalette{Palette: out}
+	}
+	cf.WarmStart = nil
+	if k == 0 {
+		return quant.LinearPalette{Palette: cf.quantize(img).palette().ColorPalette()}
+	}
+	qz := newQuantizer(img, cf.N, &cf)
+	qz.warmStart(cp)
+	if qz.roots == nil {
+		return quant.LinearPalette{Palette: out} // empty image
+	}
+	// colors of prev not near any pixel still take palette entries
+	qz.cs = qz.cs[:cf.N-k+len(qz.roots)]
+	qz.cluster()
+	byNode := map[*quant.Node]*cluster{}
+	for i := range qz.cs {
+		byNode[qz.cs[i].node] = &qz.cs[i]
+	}
+	lp := quant.LinearPalette{Palette: cp}
+	for _, root := range qz.roots {
+		var leaves []*quant.Node
+		quant.TreePalette{Root: root}.Walk(func(leaf *quant.Node, _ int) {
+			leaves = append(leaves, leaf)
+		})
+		// the color of prev that pixels of this root were nearest
+		r, g, b, a := qz.pxRGBA(int(byNode[leaves[0]].px[0]))
+		pc := cp[lp.IndexNear(color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)})]
+		// the leaf it represents
+		lc := make(color.Palette, len(leaves))
+		for i, leaf := range leaves {
+			lc[i] = leaf.Color
+		}
+		keep := lc.Index(pc)
+		for i, c := range lc {
+			if i != keep {
+				out = append(out, c)
+			}
+		}
+	}
+	return quant.LinearPalette{Palette: out}
+}
@@ -0,0 +1,83 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package median
+
+import (
+	"image"
+	"image/color"
+
+	"github.com/soniakeys/quant"
+	"github.com/soniakeys/quant/internal"
+)
+
+// grayPalette is a quant.Palette of color.Gray values with a lookup table
+// for constant time IndexNear.
+type grayPalette struct {
+	p   color.Palette
+	lut [256]int // palette index for each gray level
+}
+
+var _ quant.Palette = &grayPalette{}
+
+func (p *grayPalette) Len() int                    { return len(p.p) }
+func (p *grayPalette) ColorPalette() color.Palette { return p.p }
+
+// IndexNear returns the palette index of the nearest palette color to
+// the luminance of c.
+func (p *grayPalette) IndexNear(c color.Color) int {
+	return p.lut[color.GrayModel.Convert(c).(color.Gray).Y]
+}
+
+// ColorNear returns the nearest palette color to the luminance of c.
+func (p *grayPalette) ColorNear(c color.Color) color.Color {
+	return p.p[p.IndexNear(c)]
+}
+
+// grayQuantize quantizes a grayscale image in one dimension, gray level,
+// rather than in three dimensions of color space.  It returns false if img
+// has any pixels that are not gray or if there are no pixels.
+func (cf Config) grayQuantize(img image.Image) (*grayPalette, bool) {
+	// histogram of 8 bit gray levels
+	var counts [256]int
+	b := img.Bounds()
+	if g, ok := img.(*image.Gray); ok {
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			i := g.PixOffset(b.Min.X, y)
+			for _, v := range g.Pix[i : i+b.Dx()] {
+				counts[v]++
+			}
+		}
+	} else {
+		pxRGBA := internal.PxRGBAfunc(img)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r, g, bl, _ := pxRGBA(x, y)
+				if r != g || g != bl {
+					return nil, false
+				}
+				counts[r>>8]++
+			}
+		}
+	}
+	if b.Empty() {
+		return nil, false
+	}
+	levels := make([]color.Color, 256)
+	for i := range levels {
+		levels[i] = color.Gray{uint8(i)}
+	}
+	cf.Gray = false
+	t := cf.QuantizeHistogram(levels, counts[:]).(quant.TreePalette)
+	if t.Len() == 0 {
+		return nil, false
+	}
+	gp := &grayPalette{p: make(color.Palette, t.Len())}
+	t.Walk(func(leaf *quant.Node, i int) {
+		gp.p[i] = color.Gray{uint8(leaf.Color.R >> 8)}
+	})
+	for i := range gp.lut {
+		gp.lut[i] = t.IndexNear(levels[i])
+	}
+	return gp, true
+}
@@ -0,0 +1,127 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package median
+
+import (
+	"image"
+	"image/color"
+	"runtime"
+	"sync"
+
+	"github.com/soniakeys/quant"
+	"github.com/soniakeys/quant/internal"
+)
+
+// histBits is the precision per channel of Histogrammer bins.
+const histBits = 5
+
+const histSize = 1 << (3 * histBits)
+
+// Histogrammer accumulates a color histogram of one or more images for
+// quantization with QuantizeHistogram.
+//
+// Colors are binned at reduced precision, 5 bits per channel, in a 3-D
+// count array.  The color representing each bin is the mean of the colors
+// in the bin so no precision is lost in colors of sparse bins.
+//
+// Add counts the pixels of an image immediately, using multiple goroutines
+// that each count into a private histogram.  Results are merged by
+// element-wise addition and so do not depend on scheduling.  Images are
+// not retained, so memory use is that of the bins and does not grow with
+// the number or size of images added.
+//
+// The zero value is an empty Histogrammer ready to use.
+type Histogrammer struct {
+	h *hist // counts of added images
+}
+
+// hist holds pixel counts and channel sums for each bin.
+type hist struct {
+	n       [histSize]int
+	r, g, b [histSize]uint64
+}
+
+// Add adds the pixels of img to the histogram.
+func (h *Histogrammer) Add(img image.Image) {
+	if h.h == nil {
+		h.h = new(hist)
+	}
+	b := img.Bounds()
+	nw := runtime.NumCPU()
+	if nw > b.Dy() {
+		nw = b.Dy()
+	}
+	part := make([]*hist, nw)
+	var wg sync.WaitGroup
+	for w := range part {
+		part[w] = new(hist)
+		// worker w counts a horizontal band of img
+		wg.Add(1)
+		go func(ph *hist, y0, y1 int) {
+			ph.count(img, y0, y1)
+			wg.Done()
+		}(part[w], b.Min.Y+w*b.Dy()/nw, b.Min.Y+(w+1)*b.Dy()/nw)
+	}
+	wg.Wait()
+	for _, ph := range part {
+		h.h.merge(ph)
+	}
+}
+
+// Histogram returns the accumulated histogram as a list of colors and
+// corresponding pixel counts, as accepted by QuantizeHistogram.
+func (h *Histogrammer) Histogram() (colors []color.Color, counts []int) {
+	if h.h == nil {
+		return
+	}
+	for i, n := range h.h.n {
+		if n == 0 {
+			continue
+		}
+		n64 := uint64(n)
+		colors = append(colors, color.RGBA64{
+			uint16(h.h.r[i] / n64),
+			uint16(h.h.g[i] / n64),
+			uint16(h.h.b[i] / n64),
+			0xffff,
+		})
+		counts = append(counts, n)
+	}
+	return
+}
+
+// Palette quantizes the accumulated histogram to n colors.
+func (h *Histogrammer) Palette(n int) quant.Palette {
+	colors, counts := h.Histogram()
+	return QuantizeHistogram(colors, counts, n)
+}
+
+// count counts pixels in rows y0 through y1-1 of img.
+func (ph *hist) count(img image.Image, y0, y1 int) {
+	pxRGBA := internal.PxRGBAfunc(img)
+	const shift = 16 - histBits
+	b := img.Bounds()
+	for y := y0; y < y1; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := pxRGBA(x, y)
+			i := r>>shift<<(2*histBits) | g>>shift<<histBits | bl>>shift
+			ph.n[i]++
+			ph.r[i] += uint64(r)
+			ph.g[i] += uint64(g)
+			ph.b[i] += uint64(bl)
+		}
+	}
+}
+
+// merge adds counts and sums of ph into h.
+func (h *hist) merge(ph *hist) {
+	for i, n := range ph.n {
+		if n > 0 {
+			h.n[i] += n
+			h.r[i] += ph.r[i]
+			h.g[i] += ph.g[i]
+			h.b[i] += ph.b[i]
+		}
+	}
+}
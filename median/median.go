@@ -2,6 +2,14 @@
 // Licensed under MIT license.  See "license" file in this source tree.
 
 // Median implements basic median cut color quantization.
+//
+// Working memory beyond the image and the result is a pixel index and a
+// channel value buffer, 6 bytes per pixel.  Pixels of an *image.RGBA with
+// no padding between rows are read directly from the Pix slice.  Images of
+// types other than those of the standard image package are read once with
+// At into a color cache of a further 8 bytes per pixel, so that expensive
+// At methods are not called repeatedly.  See also Config.TwoPass for lower
+// memory use on very large images.
 package median
 
 import (
@@ -11,6 +19,7 @@ import (
 	"image/draw"
 	"math"
 	"sort"
+	"time"
 
 	"github.com/soniakeys/quant"
 	"github.com/soniakeys/quant/internal"
@@ -28,31 +37,23 @@ type Quantizer int
 var _ quant.Quantizer = Quantizer(0)
 var _ draw.Quantizer = Quantizer(0)
 
+func init() {
+	quant.Register("median", func(n int) quant.Quantizer { return Quantizer(n) })
+}
+
 // Paletted performs color quantization and returns a paletted image.
 //
 // Returned is an image.Paletted with no more than q colors. Note though
 // that image.Paletted is limited to 256 colors.
 func (q Quantizer) Paletted(img image.Image) *image.Paletted {
-	n := int(q)
-	if n > 256 {
-		n = 256
-	}
-	qz := newQuantizer(img, n)
-	if n > 1 {
-		qz.cluster() // cluster pixels by color
-	}
-	return qz.paletted() // generate paletted image from clusters
+	return Config{N: int(q)}.Paletted(img)
 }
 
 // Palette performs color quantization and returns a quant.Palette object.
 //
 // Returned is a palette with no more than q colors. Q may be > 256.
 func (q Quantizer) Palette(img image.Image) quant.Palette {
-	qz := newQuantizer(img, int(q))
-	if q > 1 {
-		qz.cluster() // cluster pixels by color
-	}
-	return qz.t
+	return Config{N: int(q)}.Palette(img)
 }
 
 // Quantize performs color quantization and returns a color.Palette.
@@ -62,13 +63,916 @@ func (q Quantizer) Palette(img image.Image) quant.Palette {
 // updated palette...."  This method does not limit the number of colors
 // to 256.  Cap(p) or the quantity cap(p) - len(p) may be > 256.
 // Also for this method the value of the Quantizer object is ignored.
-func (Quantizer) Quantize(p color.Palette, m image.Image) color.Palette {
-	n := cap(p) - len(p)
-	qz := newQuantizer(m, n)
-	if n > 1 {
-		qz.cluster() // cluster pixels by color
+func (q Quantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+	return Config{N: int(q)}.Quantize(p, m)
+}
+
+// Config is a Quantizer with options.
+//
+// N is the target number of colors, as with the value of a Quantizer.
+// The zero value of each other field selects the behavior of Quantizer,
+// so Config{N: n} quantizes exactly as Quantizer(n) does.
+//
+// Like Quantizer, Config satisfies both quant.Quantizer and draw.Quantizer.
+type Config struct {
+	N int
+
+	// Priority selects the rule for choosing the next cluster to split.
+	Priority Priority
+
+	// BalanceTies, if true, cuts clusters at the median value and divides
+	// pixels equal to the cut value between the two new clusters so that
+	// the clusters are of nearly equal size.  By default all pixels equal
+	// to the cut value go to one cluster, which can leave clusters lopsided
+	// when many pixels share the value.  Note that with BalanceTies pixels
+	// of the same color may be represented by different palette colors.
+	BalanceTies bool
+
+	// TwoPass, if true, saves memory on large images by not keeping a list
+	// of all pixels.  A first pass over the image builds a histogram as
+	// with Histogrammer and the palette is derived from the histogram.
+	// Paletted then makes a second pass over the image, mapping each pixel
+	// to the palette with IndexNear.  Results differ somewhat from the
+	// default because histogram bins have reduced precision.
+	TwoPass bool
+
+	// Ramps are ordered color lists, such as color ramps of pixel art,
+	// included verbatim at the start of the palette, each consuming
+	// len(ramp) of the N colors.  Remaining colors are derived by clustering
+	// pixels that do not exactly match a ramp color.  Pixels are then mapped
+	// to the nearest palette color, ramp or derived.  If ramps have N or
+	// more colors in total, the palette is just the ramp colors.  Ramps take
+	// precedence over TwoPass.
+	Ramps [][]color.Color
+
+	// InverseFrequency, if > 0, weights pixels by the inverse of the
+	// frequency of their exact color, with a floor of 1/InverseFrequency.
+	// Equivalently, each distinct color counts as max(count,
+	// InverseFrequency) pixels.  Colors of large areas still count by
+	// population but rare colors, such as those of small distinct objects,
+	// count as InverseFrequency pixels and are more likely to earn a palette
+	// color.  Pixels are then mapped to the nearest palette color.
+	// InverseFrequency takes precedence over TwoPass.
+	InverseFrequency int
+
+	// AlphaThreshold, if > 0, excludes pixels with alpha below the threshold
+	// from palette derivation.  Such pixels are mapped to a transparent
+	// palette color reserved at index 0, which consumes one of the N colors.
+	// The remaining colors are derived solely from visible pixels.
+	// AlphaThreshold takes precedence over other options that change the
+	// mapping of pixels, Gray, Ramps, and TwoPass.
+	AlphaThreshold uint16
+
+	// Background, if not nil, is a background color over which pixels are
+	// composited before quantization, as when an image with transparency
+	// will be displayed over a known background.  The palette is then
+	// derived from colors as they will appear.  Fully transparent pixels
+	// take the background color, or with AlphaThreshold, pixels below the
+	// threshold still take the transparent color at index 0.
+	Background color.Color
+
+	// ChromaKey, if not nil, excludes pixels of a key color from palette
+	// derivation, as with green screen sources.  Pixels within
+	// ChromaTolerance of ChromaKey in each of red, green, and blue are
+	// mapped to the transparent color reserved at index 0 as with
+	// AlphaThreshold, and ChromaKey likewise takes precedence over Gray,
+	// Ramps, and TwoPass.  Unlike AlphaThreshold the key is an RGB value
+	// and alpha is ignored.  The two options may be used together.
+	ChromaKey color.Color
+
+	// ChromaTolerance is the tolerance of ChromaKey in 16 bit color units.
+	// Zero excludes only exact matches of the key color.
+	ChromaTolerance uint16
+
+	// Gray, if true, detects grayscale images and quantizes them by gray
+	// level alone.  The palette then holds color.Gray values, which some
+	// encoders store more compactly, and pixels are mapped to the palette
+	// by table lookup.  Images with any non-gray pixels are quantized
+	// normally.
+	Gray bool
+
+	// Split, if not nil, replaces the median cut rules for choosing
+	// clusters to split and values at which to split them.
+	Split SplitStrategy
+
+	// ToWorking, if not nil, transforms pixel colors to a working color
+	// space, such as one defined by an ICC profile, in which clustering is
+	// done.  FromWorking, if not nil, transforms colors representing
+	// clusters back for the palette.  Palette IndexNear and ColorNear
+	// methods transform argument colors with ToWorking.
+	ToWorking, FromWorking func(color.Color) color.Color
+
+	// WarmStart, if it has fewer than N colors, is a palette such as from
+	// an earlier quantization at fewer colors, used to start clustering.
+	// Pixels are first assigned to clusters by nearest WarmStart color and
+	// clustering continues by splitting these clusters up to N.  This is
+	// faster than starting from a single cluster but results differ
+	// somewhat.  Palettes are then LinearPalettes rather than TreePalettes
+	// because the initial clusters are not divided by a tree.  WarmStart
+	// applies only where pixels are mapped by cluster, not with options
+	// such as TwoPass.
+	WarmStart color.Palette
+
+	// HybridChroma, if > 0, selects the channel to split per cluster.
+	// For clusters with a center color of CIE L*a*b* chroma below
+	// HybridChroma, that is, near-neutral clusters where perceptual
+	// differences matter most, the RGB channel to split is the one whose
+	// range makes the greatest L*a*b* color difference.  More saturated
+	// clusters are split in the channel with the widest RGB range as
+	// usual.  A threshold around 20 is a reasonable start.
+	HybridChroma float64
+
+	// ColorModel, if not nil, converts colors of the palettes of paletted
+	// images, for example to color.NRGBAModel so that alpha semantics are
+	// explicit for encoders.  By default palette colors are color.RGBA64.
+	// Colors of TreePalettes remain color.RGBA64.
+	ColorModel color.Model
+
+	// Budget, if > 0, limits the time spent splitting clusters.  When the
+	// budget is exceeded splitting stops and the palette is built from the
+	// clusters so far, so it may have fewer than N colors.  This protects
+	// servers from pathological inputs such as huge images of nearly all
+	// distinct colors.  Results then depend on machine speed and load.
+	Budget time.Duration
+
+	// Representative selects how the palette color representing each
+	// cluster is chosen.  The default is Mean.
+	Representative Representative
+
+	// Sample, if > 0 and less than the number of pixels of an image,
+	// derives the palette from a sample of Sample pixels rather than from
+	// all pixels, which is faster for large images.  All pixels are then
+	// mapped to the nearest palette color.  Sample applies only where
+	// pixels are mapped by cluster, not with options AlphaThreshold,
+	// ChromaKey, or those such as TwoPass that map by palette.
+	Sample int
+
+	// Sampling selects how pixels are sampled for Sample.  The default is
+	// Strided.
+	Sampling Sampling
+
+	// Seed seeds the pseudo-random permutation of Shuffled sampling.  For
+	// a given Seed, results are reproducible.
+	Seed int64
+
+	// ExactDominant, if true, represents the cluster containing the most
+	// common color of the image by exactly that color, rather than by the
+	// Representative color of the cluster.  A large flat background is
+	// then reproduced exactly and matches non-quantized content around
+	// it.
+	ExactDominant bool
+
+	// Channel selects the rule for choosing the color channel in which to
+	// split a cluster.  The default is WidestRange.  HybridChroma, if set,
+	// takes precedence for near-neutral clusters.
+	Channel ChannelRule
+
+	// Timing, if not nil, collects time spent in the scan, cut, and split
+	// phases of clustering.  Times are added to the fields of Timing.
+	Timing *quant.Timing
+
+	// Linear, if true, measures channel ranges in linear light rather than
+	// in gamma encoded color values when choosing the channel to split and
+	// when computing color volume for PopulationVolume.  It affects only
+	// split decisions.  Palette colors are still averages of gamma encoded
+	// values.  Note that linear light compresses dark values relative to
+	// gamma encoding, so with PopulationVolume, Linear gives shadows fewer
+	// palette colors and highlights more, not the reverse.
+	Linear bool
+
+	// Canonical, if true, orders palettes returned by Paletted, Palette,
+	// ImageAndPalette, and Quantize canonically, by quant.OrderCanonical,
+	// with image indexes remapped accordingly.  Identical color sets then
+	// always have the same order regardless of the order of splits, for
+	// diffing or caching of results.  Palettes are then LinearPalettes.
+	Canonical bool
+
+	// Locality, if true, keeps the points of each cluster in image memory
+	// order.  By default splitting partitions points in place by swapping,
+	// leaving them in scrambled order so that on large images reading
+	// pixels can thrash the cache.  With Locality the partition is stable,
+	// using a buffer of one point per pixel.  Whether this is faster
+	// depends on the image and machine, see BenchmarkLocality.  Results
+	// are the same except with BalanceTies, where which tied pixels go to
+	// which cluster may differ.  Locality has no effect on histograms.
+	Locality bool
+
+	// MinLuminance and MaxLuminance, if not zero, bound the luminance of
+	// palette colors, in 16 bit units, for palettes used as theme colors
+	// where near-black or near-white entries are unusable.  Luminance is
+	// computed as by color.GrayModel.  A cluster color outside the bounds
+	// is moved to the nearest bound by shifting all channels equally,
+	// except that channels stop at 0 or 0xffff.  Pixels stay mapped to
+	// their clusters, only palette colors change.  The bounds apply after
+	// ExactDominant.  Zero MaxLuminance means no upper bound.
+	MinLuminance, MaxLuminance uint16
+}
+
+var _ quant.Quantizer = Config{}
+var _ draw.Quantizer = Config{}
+
+// Priority values select the rule for choosing the next cluster to split.
+type Priority int
+
+const (
+	// Population splits the cluster with the most pixels.
+	Population Priority = iota
+	// PopulationVolume splits the cluster with the greatest product of
+	// pixel population and color volume.  Compared to Population it keeps
+	// large areas of nearly flat color from taking palette entries away
+	// from smaller but more colorful areas.
+	PopulationVolume
+)
+
+// ChannelRule values select the rule for choosing the color channel in
+// which to split a cluster.
+type ChannelRule int
+
+const (
+	// WidestRange splits in the channel with the widest range of values.
+	WidestRange ChannelRule = iota
+	// GreatestVariance splits in the channel with the greatest variance
+	// of values.  Range is sensitive to outliers, a single stray pixel
+	// can make a channel look wide, while variance reflects where the
+	// pixels of a cluster are spread.  This often gives better splits
+	// with noisy images.
+	GreatestVariance
+)
+
+// Representative values select the color representing a cluster.
+type Representative int
+
+const (
+	// Mean represents a cluster by the average color of its pixels.
+	Mean Representative = iota
+	// Mode represents a cluster by its most populous exact color.  Palette
+	// colors are then colors of the image, and with flat shaded art the
+	// dominant color of each region is preserved exactly.
+	Mode
+)
+
+// Paletted performs color quantization and returns a paletted image.
+//
+// Returned is an image.Paletted with no more than cf.N colors. Note though
+// that image.Paletted is limited to 256 colors.
+func (cf Config) Paletted(img image.Image) *image.Paletted {
+	return cf.model(cf.canonicalPaletted(cf.paletted(img)))
+}
+
+// canonicalPaletted reorders the palette of pi canonically if cf.Canonical
+// is set.
+func (cf Config) canonicalPaletted(pi *image.Paletted) *image.Paletted {
+	if cf.Canonical {
+		p, remap := quant.OrderCanonical(quant.LinearPalette{Palette: pi.Palette})
+		quant.Reindex(pi, p, remap)
+	}
+	return pi
+}
+
+// canonical returns p reordered canonically if cf.Canonical is set.
+func (cf Config) canonical(p quant.Palette) quant.Palette {
+	if cf.Canonical {
+		p, _ = quant.OrderCanonical(p)
+	}
+	return p
+}
+
+// model converts the palette of pi by cf.ColorModel.  The palette is
+// replaced rather than modified as it may be shared.
+func (cf Config) model(pi *image.Paletted) *image.Paletted {
+	pi.Palette = cf.modelPalette(pi.Palette)
+	return pi
+}
+
+// modelPalette returns cp converted by cf.ColorModel, or cp itself if
+// ColorModel is nil.
+func (cf Config) modelPalette(cp color.Palette) color.Palette {
+	if cf.ColorModel == nil {
+		return cp
+	}
+	m := make(color.Palette, len(cp))
+	for i, c := range cp {
+		m[i] = cf.ColorModel.Convert(c)
+	}
+	return m
+}
+
+// paletted does the work of Paletted, without ColorModel.
+func (cf Config) paletted(img image.Image) *image.Paletted {
+	img = cf.composite(img)
+	if cf.N > 256 {
+		cf.N = 256
+	}
+	if cf.ToWorking != nil {
+		pi, _ := cf.working(img, true)
+		return pi
+	}
+	if cf.reserved() {
+		return cf.alphaQuantize(img).alphaPaletted()
+	}
+	if p, ok := cf.altPalette(img); ok {
+		return quant.Paletted(p, img)
+	}
+	qz := cf.quantize(img)
+	return qz.paletted() // generate paletted image from clusters
+}
+
+// Palette performs color quantization and returns a quant.Palette object.
+//
+// Returned is a palette with no more than cf.N colors. N may be > 256.
+func (cf Config) Palette(img image.Image) quant.Palette {
+	return cf.canonical(cf.palette(img))
+}
+
+// palette does the work of Palette, without Canonical.
+func (cf Config) palette(img image.Image) quant.Palette {
+	img = cf.composite(img)
+	if cf.ToWorking != nil {
+		_, p := cf.working(img, false)
+		return p
+	}
+	if cf.reserved() {
+		return quant.LinearPalette{Palette: cf.alphaQuantize(img).alphaPalette()}
+	}
+	if p, ok := cf.altPalette(img); ok {
+		return p
+	}
+	return cf.quantize(img).palette()
+}
+
+// TreePalette performs color quantization and returns a quant.TreePalette
+// representing the splits made in clustering.
+//
+// IndexNear and ColorNear of a TreePalette search the tree rather than
+// comparing each color, so for the common pattern of deriving a palette
+// and then mapping images to it, lookups are by tree depth rather than
+// by number of colors.  Lookups reproduce the clustering, so that
+// ColorNear of any pixel of img gives the palette color of the pixel in
+// Paletted.  The exception is with option BalanceTies, where pixels with
+// the cut value may be in either cluster but are looked up in the upper
+// one.  See Config.TreePalette for options.
+func (q Quantizer) TreePalette(img image.Image) *quant.TreePalette {
+	return Config{N: int(q)}.TreePalette(img)
+}
+
+// TreePalette performs color quantization and returns a quant.TreePalette
+// representing the splits made in clustering.  See Quantizer.TreePalette.
+//
+// Options that map pixels other than by clusters split from a single tree,
+// AlphaThreshold, ChromaKey, Gray, Ramps, TwoPass, InverseFrequency,
+// ToWorking, and WarmStart, are ignored.
+func (cf Config) TreePalette(img image.Image) *quant.TreePalette {
+	img = cf.composite(img)
+	cf.WarmStart = nil
+	t := cf.quantize(img).t
+	return &t
+}
+
+// Quantize performs color quantization and returns a color.Palette.
+//
+// As with Quantizer.Quantize, the number of colors is determined by p and
+// cf.N is ignored.  Other options of cf are used.
+func (cf Config) Quantize(p color.Palette, m image.Image) color.Palette {
+	cf.N = cap(p) - len(p)
+	return p[:len(p)+copy(p[len(p):cap(p)], cf.Palette(m).ColorPalette())]
+}
+
+// ImageAndPalette performs color quantization and returns both a paletted
+// image and a quant.Palette object, as Paletted and Palette would, but
+// clustering only once.
+//
+// As with Paletted, the number of colors is limited to 256.
+func (q Quantizer) ImageAndPalette(img image.Image) (*image.Paletted, quant.Palette) {
+	return Config{N: int(q)}.ImageAndPalette(img)
+}
+
+// ImageAndPalette performs color quantization and returns both a paletted
+// image and a quant.Palette object, as Paletted and Palette would, but
+// clustering only once.
+//
+// As with Paletted, the number of colors is limited to 256.
+func (cf Config) ImageAndPalette(img image.Image) (*image.Paletted, quant.Palette) {
+	pi, p := cf.imageAndPalette(img)
+	if cf.Canonical {
+		pi = cf.canonicalPaletted(pi)
+		p = quant.LinearPalette{Palette: pi.Palette}
+	}
+	return cf.model(pi), p
+}
+
+// imageAndPalette does the work of ImageAndPalette, without ColorModel.
+func (cf Config) imageAndPalette(img image.Image) (*image.Paletted, quant.Palette) {
+	img = cf.composite(img)
+	if cf.N > 256 {
+		cf.N = 256
+	}
+	if cf.ToWorking != nil {
+		return cf.working(img, true)
+	}
+	if cf.reserved() {
+		pi := cf.alphaQuantize(img).alphaPaletted()
+		return pi, quant.LinearPalette{Palette: pi.Palette}
+	}
+	if p, ok := cf.altPalette(img); ok {
+		return quant.Paletted(p, img), p
+	}
+	qz := cf.quantize(img)
+	return qz.paletted(), qz.palette()
+}
+
+// Indexed performs color quantization and returns an image of palette
+// indexes.
+//
+// Unlike Paletted, Indexed does not limit the number of colors to 256.
+// If q is no more than 256 the result is an *image.Paletted as returned
+// by Paletted.  Otherwise it is a *quant.IndexedImage, with 16 bit
+// indexes, of up to q colors.
+func (q Quantizer) Indexed(img image.Image) image.Image {
+	return Config{N: int(q)}.Indexed(img)
+}
+
+// Indexed performs color quantization and returns an image of palette
+// indexes.
+//
+// Unlike Paletted, Indexed does not limit the number of colors to 256.
+// If cf.N is no more than 256 the result is an *image.Paletted as returned
+// by Paletted.  Otherwise it is a *quant.IndexedImage, with 16 bit
+// indexes, of up to cf.N colors.  N is limited to 65536.
+func (cf Config) Indexed(img image.Image) image.Image {
+	img = cf.composite(img)
+	if cf.N <= 256 {
+		return cf.Paletted(img)
 	}
-	return p[:len(p)+copy(p[len(p):cap(p)], qz.t.ColorPalette())]
+	if cf.N > 1<<16 {
+		cf.N = 1 << 16
+	}
+	var ii *quant.IndexedImage
+	switch {
+	case cf.ToWorking != nil:
+		_, p := cf.working(img, false)
+		ii = quant.Indexed(p, img)
+	case cf.reserved():
+		qz := cf.alphaQuantize(img)
+		ii = qz.indexed(qz.alphaPalette(), 1)
+	default:
+		if p, ok := cf.altPalette(img); ok {
+			ii = quant.Indexed(p, img)
+		} else {
+			qz := cf.quantize(img)
+			ii = qz.indexed(qz.palette().ColorPalette(), 0)
+		}
+	}
+	ii.Palette = cf.modelPalette(ii.Palette)
+	return ii
+}
+
+// ImageWithClusters performs color quantization and returns a paletted
+// image and, by palette index, the points of img mapped to each palette
+// color.  See Config.ImageWithClusters.
+func (q Quantizer) ImageWithClusters(img image.Image) (*image.Paletted, [][]image.Point) {
+	return Config{N: int(q)}.ImageWithClusters(img)
+}
+
+// ImageWithClusters performs color quantization and returns a paletted
+// image and, by palette index, the points of img mapped to each palette
+// color.
+//
+// This is useful for example for editors where clicking a palette color
+// selects all pixels of that color.  The paletted image is as returned by
+// Paletted.  Points are in the coordinates of img, in row-major order.
+func (cf Config) ImageWithClusters(img image.Image) (*image.Paletted, [][]image.Point) {
+	pi := cf.Paletted(img)
+	pts := make([][]image.Point, len(pi.Palette))
+	b := pi.Rect
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := pi.Pix[pi.PixOffset(b.Min.X, y):][:b.Dx()]
+		for x, i := range row {
+			if int(i) < len(pts) {
+				pts[i] = append(pts[i], image.Pt(b.Min.X+x, y))
+			}
+		}
+	}
+	return pi, pts
+}
+
+// quantize clusters the pixels of img by the options of cf.
+func (cf Config) quantize(img image.Image) *quantizer {
+	qz := newQuantizer(img, cf.N, &cf)
+	var all []point // all points, if a sample is clustered
+	if cf.N > 1 {
+		all = qz.sample()
+	}
+	if len(cf.WarmStart) > 0 && len(cf.WarmStart) < cf.N {
+		qz.warmStart(cf.WarmStart)
+	}
+	qz.cluster() // cluster pixels by color
+	if all != nil {
+		qz.assign(all)
+	}
+	return qz
+}
+
+// working quantizes img in the working space of cf.ToWorking, returning
+// a palette of colors transformed by cf.FromWorking and if paletted is
+// true, a paletted image with that palette.
+func (cf Config) working(img image.Image, paletted bool) (*image.Paletted, quant.Palette) {
+	to := cf.ToWorking
+	cf.ToWorking = nil
+	b := img.Bounds()
+	w := image.NewRGBA64(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			w.Set(x, y, to(img.At(x, y)))
+		}
+	}
+	var pi *image.Paletted
+	var p quant.Palette
+	if paletted {
+		pi, p = cf.ImageAndPalette(w)
+	} else {
+		p = cf.Palette(w)
+	}
+	wp := &workingPalette{p, to, p.ColorPalette()}
+	if cf.FromWorking != nil {
+		cp := make(color.Palette, len(wp.cp))
+		for i, c := range wp.cp {
+			cp[i] = cf.FromWorking(c)
+		}
+		wp.cp = cp
+	}
+	if pi != nil {
+		pi.Palette = wp.cp
+	}
+	return pi, wp
+}
+
+// workingPalette is a quant.Palette for Config.ToWorking.  Colors are
+// looked up in working palette p after transforming them with to.
+type workingPalette struct {
+	p  quant.Palette
+	to func(color.Color) color.Color
+	cp color.Palette // colors transformed from the working space
+}
+
+func (p *workingPalette) Len() int                    { return len(p.cp) }
+func (p *workingPalette) ColorPalette() color.Palette { return p.cp }
+
+func (p *workingPalette) IndexNear(c color.Color) int {
+	return p.p.IndexNear(p.to(c))
+}
+
+func (p *workingPalette) ColorNear(c color.Color) color.Color {
+	return p.cp[p.IndexNear(c)]
+}
+
+// composite returns img composited over cf.Background, or img itself if
+// Background is nil.
+func (cf Config) composite(img image.Image) image.Image {
+	if cf.Background == nil {
+		return img
+	}
+	return over{img, cf.Background, uint32(cf.AlphaThreshold)}
+}
+
+// over is an image composited over background color bg.  Pixels with alpha
+// below threshold are left as is.
+type over struct {
+	image.Image
+	bg        color.Color
+	threshold uint32
+}
+
+func (o over) At(x, y int) color.Color {
+	r, g, b, a := o.Image.At(x, y).RGBA()
+	if a < o.threshold || a == 0xffff {
+		return color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)}
+	}
+	// premultiplied source over background
+	br, bg, bb, ba := o.bg.RGBA()
+	t := 0xffff - a
+	return color.RGBA64{
+		uint16(r + br*t/0xffff),
+		uint16(g + bg*t/0xffff),
+		uint16(b + bb*t/0xffff),
+		uint16(a + ba*t/0xffff),
+	}
+}
+
+// reserved returns true if options AlphaThreshold or ChromaKey reserve
+// index 0 for excluded pixels.
+func (cf Config) reserved() bool {
+	return cf.AlphaThreshold > 0 || cf.ChromaKey != nil
+}
+
+// excluded returns a function that returns true for pixels excluded by
+// options AlphaThreshold and ChromaKey.
+func (cf Config) excluded() func(r, g, b, a uint32) bool {
+	var kr, kg, kb uint32
+	if cf.ChromaKey != nil {
+		kr, kg, kb, _ = cf.ChromaKey.RGBA()
+	}
+	tol := uint32(cf.ChromaTolerance)
+	near := func(v, k uint32) bool {
+		if v > k {
+			return v-k <= tol
+		}
+		return k-v <= tol
+	}
+	return func(r, g, b, a uint32) bool {
+		if a < uint32(cf.AlphaThreshold) {
+			return true
+		}
+		return cf.ChromaKey != nil &&
+			near(r, kr) && near(g, kg) && near(b, kb)
+	}
+}
+
+// alphaQuantize clusters pixels not excluded by cf.AlphaThreshold or
+// cf.ChromaKey into cf.N-1 clusters.
+func (cf Config) alphaQuantize(img image.Image) *quantizer {
+	qz := newQuantizer(img, cf.N-1, &cf)
+	qz.skip(cf.excluded())
+	qz.cluster() // cluster visible pixels by color
+	return qz
+}
+
+// alphaPalette returns the palette for options AlphaThreshold and
+// ChromaKey, the transparent color followed by cluster colors.
+func (qz *quantizer) alphaPalette() color.Palette {
+	p := color.Palette{color.RGBA64{}}
+	if len(qz.cs) > 0 {
+		p = append(p, qz.t.ColorPalette()...)
+	}
+	return p
+}
+
+// alphaPaletted generates a paletted image for options AlphaThreshold and
+// ChromaKey.
+// Pixels not in any cluster get the transparent color at index 0.
+func (qz *quantizer) alphaPaletted() *image.Paletted {
+	pi := image.NewPaletted(qz.img.Bounds(), qz.alphaPalette())
+	for i := range qz.cs {
+		x := uint8(qz.cs[i].node.Index + 1)
+		for _, p := range qz.cs[i].px {
+			pi.Pix[p] = x
+		}
+	}
+	return pi
+}
+
+// RGBAImage performs color quantization and returns a full color image
+// with each pixel replaced by the color representing it.
+//
+// It is like Paletted but saves a palette lookup pass for callers that
+// are not index-aware.
+func (q Quantizer) RGBAImage(img image.Image) *image.NRGBA {
+	return Config{N: int(q)}.RGBAImage(img)
+}
+
+// RGBAImage performs color quantization and returns a full color image
+// with each pixel replaced by the color representing it.
+//
+// Unlike Paletted, RGBAImage is not limited to 256 colors.
+func (cf Config) RGBAImage(img image.Image) *image.NRGBA {
+	img = cf.composite(img)
+	if cf.ToWorking != nil {
+		if cf.N > 256 {
+			cf.N = 256
+		}
+		pi, _ := cf.working(img, true)
+		return nrgba(pi)
+	}
+	if cf.reserved() {
+		if cf.N > 256 {
+			cf.N = 256
+		}
+		return nrgba(cf.alphaQuantize(img).alphaPaletted())
+	}
+	if p, ok := cf.altPalette(img); ok {
+		// no clusters, pixels are mapped by nearest color.
+		b := img.Bounds()
+		pxRGBA := internal.PxRGBAfunc(img)
+		ni := image.NewNRGBA(b)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r, g, b, a := pxRGBA(x, y)
+				ni.Set(x, y, p.ColorNear(color.RGBA64{
+					uint16(r), uint16(g), uint16(b), uint16(a)}))
+			}
+		}
+		return ni
+	}
+	qz := cf.quantize(img)
+	ni := image.NewNRGBA(img.Bounds())
+	for i := range qz.cs {
+		c := color.NRGBAModel.Convert(qz.cs[i].node.Color).(color.NRGBA)
+		for _, p := range qz.cs[i].px {
+			copy(ni.Pix[4*p:], []uint8{c.R, c.G, c.B, c.A})
+		}
+	}
+	return ni
+}
+
+// QuantizeInPlaceType performs color quantization and returns an image of
+// the same concrete type as img with each pixel set to its palette color.
+// See Config.QuantizeInPlaceType.
+func (q Quantizer) QuantizeInPlaceType(img image.Image) image.Image {
+	return Config{N: int(q)}.QuantizeInPlaceType(img)
+}
+
+// QuantizeInPlaceType performs color quantization and returns an image of
+// the same concrete type as img with each pixel set to its palette color.
+//
+// Img itself is not modified.  The standard library types *image.RGBA,
+// *image.RGBA64, *image.NRGBA, *image.NRGBA64, *image.Gray, *image.Gray16,
+// and *image.CMYK are returned as the same type, with colors as in the
+// result of RGBAImage.  An *image.Paletted is returned as the result of
+// Paletted.  For other types, including *image.YCbCr which cannot hold
+// arbitrary colors per pixel, the result is the *image.NRGBA of RGBAImage.
+func (cf Config) QuantizeInPlaceType(img image.Image) image.Image {
+	if _, ok := img.(*image.Paletted); ok {
+		return cf.Paletted(img)
+	}
+	ni := cf.RGBAImage(img)
+	b := img.Bounds()
+	var dst draw.Image
+	switch img.(type) {
+	case *image.RGBA:
+		dst = image.NewRGBA(b)
+	case *image.RGBA64:
+		dst = image.NewRGBA64(b)
+	case *image.NRGBA64:
+		dst = image.NewNRGBA64(b)
+	case *image.Gray:
+		dst = image.NewGray(b)
+	case *image.Gray16:
+		dst = image.NewGray16(b)
+	case *image.CMYK:
+		dst = image.NewCMYK(b)
+	default:
+		return ni
+	}
+	draw.Draw(dst, b, ni, b.Min, draw.Src)
+	return dst
+}
+
+// nrgba converts a paletted image to NRGBA.
+func nrgba(pi *image.Paletted) *image.NRGBA {
+	ni := image.NewNRGBA(pi.Rect)
+	draw.Draw(ni, pi.Rect, pi, pi.Rect.Min, draw.Src)
+	return ni
+}
+
+// altPalette returns a palette of cf.N colors and true for options where
+// pixels are mapped to the palette by nearest color rather than by cluster.
+// It returns false if no such option is set.
+func (cf Config) altPalette(img image.Image) (quant.Palette, bool) {
+	if cf.Gray {
+		if p, ok := cf.grayQuantize(img); ok {
+			return p, true
+		}
+	}
+	switch {
+	case len(cf.Ramps) > 0:
+		return cf.rampPalette(img), true
+	case cf.InverseFrequency > 0:
+		return cf.freqPalette(img), true
+	case cf.TwoPass:
+		return cf.histPalette(img), true
+	}
+	return nil, false
+}
+
+// histPalette derives a palette of cf.N colors from a histogram of img.
+func (cf Config) histPalette(img image.Image) quant.Palette {
+	var h Histogrammer
+	h.Add(img)
+	colors, counts := h.Histogram()
+	return cf.QuantizeHistogram(colors, counts)
+}
+
+// freqPalette derives a palette of cf.N colors from the exact colors of
+// img, weighted by population with a floor of cf.InverseFrequency.
+func (cf Config) freqPalette(img image.Image) quant.Palette {
+	var t tally
+	t.add(img, nil)
+	for i, n := range t.counts {
+		if n < cf.InverseFrequency {
+			t.counts[i] = cf.InverseFrequency
+		}
+	}
+	return cf.QuantizeHistogram(t.colors, t.counts)
+}
+
+// tally is a histogram of exact colors.
+type tally struct {
+	m      map[color.RGBA64]int // color to index in colors, counts
+	colors []color.Color
+	counts []int
+}
+
+// add counts the pixels of img, except those where skip returns true.
+// Skip may be nil.
+func (t *tally) add(img image.Image, skip func(r, g, b, a uint32) bool) {
+	t.addWeighted(img, skip, 1)
+}
+
+// addWeighted is add, counting each pixel w times.
+func (t *tally) addWeighted(img image.Image, skip func(r, g, b, a uint32) bool, w int) {
+	if t.m == nil {
+		t.m = map[color.RGBA64]int{}
+	}
+	b := img.Bounds()
+	pxRGBA := internal.PxRGBAfunc(img)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, b, a := pxRGBA(x, y)
+			if skip != nil && skip(r, g, b, a) {
+				continue
+			}
+			c := color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)}
+			if i, ok := t.m[c]; ok {
+				t.counts[i] += w
+				continue
+			}
+			t.m[c] = len(t.colors)
+			t.colors = append(t.colors, c)
+			t.counts = append(t.counts, w)
+		}
+	}
+}
+
+// rampPalette returns a palette of the colors of cf.Ramps followed by
+// colors derived from pixels not exactly matching a ramp color.
+func (cf Config) rampPalette(img image.Image) quant.Palette {
+	var p color.Palette
+	ramp := map[color.RGBA64]bool{}
+	for _, r := range cf.Ramps {
+		for _, c := range r {
+			p = append(p, c)
+			ramp[rgba64(c)] = true
+		}
+	}
+	n := cf.N - len(p)
+	qz := newQuantizer(img, n, &cf)
+	qz.skip(func(r, g, b, a uint32) bool {
+		return ramp[color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)}]
+	})
+	qz.cluster() // cluster remaining pixels by color
+	p = append(p, qz.t.ColorPalette()...)
+	return quant.LinearPalette{Palette: p}
+}
+
+// rgba64 converts a color to color.RGBA64.
+func rgba64(c color.Color) color.RGBA64 {
+	r, g, b, a := c.RGBA()
+	return color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)}
+}
+
+// Gamuts performs color quantization and returns the gamut, or RGB bounding
+// box, of the pixels represented by each palette color.
+//
+// Gamuts are indexed as the palette returned by Palette.
+func (q Quantizer) Gamuts(img image.Image) []quant.Gamut {
+	return Config{N: int(q)}.Gamuts(img)
+}
+
+// Gamuts performs color quantization and returns the gamut, or RGB bounding
+// box, of the pixels represented by each palette color.
+//
+// Gamuts are indexed as the palette returned by Palette.
+func (cf Config) Gamuts(img image.Image) []quant.Gamut {
+	img = cf.composite(img)
+	qz := newQuantizer(img, cf.N, &cf)
+	if len(qz.cs) == 0 {
+		return nil
+	}
+	qz.cluster() // cluster pixels by color
+	g := make([]quant.Gamut, len(qz.cs))
+	for i := range qz.cs {
+		c := &qz.cs[i]
+		qz.setWidestChannel(c) // (re)compute extents
+		g[c.node.Index] = c.gamut
+	}
+	return g
+}
+
+// QuantizeHistogram performs color quantization on a color histogram rather
+// than an image.
+//
+// Argument counts gives the number of occurrences of the corresponding
+// color in colors.  Colors with counts < 1 are ignored.  Returned is a
+// palette with no more than n colors.
+func QuantizeHistogram(colors []color.Color, counts []int, n int) quant.Palette {
+	return Config{N: n}.QuantizeHistogram(colors, counts)
+}
+
+// QuantizeHistogram performs color quantization on a color histogram
+// using the options of cf.  See the package function QuantizeHistogram.
+func (cf Config) QuantizeHistogram(colors []color.Color, counts []int) quant.Palette {
+	qz := newHistQuantizer(colors, counts, cf.N, &cf)
+	qz.cluster() // cluster colors
+	return qz.t
 }
 
 type quantizer struct {
@@ -76,17 +980,29 @@ type quantizer struct {
 	cs  []cluster         // len(cs) is the desired number of colors
 	ch  chValues          // buffer for computing median
 	t   quant.TreePalette // root
+	cf  *Config           // options
+	wt  []int             // point weights, nil for images
+	buf []point           // buffer for stableSplit
+	// roots of trees of warm start clusters, nil if not warm started
+	roots    []*quant.Node
+	deadline time.Time // end of Config.Budget, or zero
 
-	pxRGBA func(x, y int) (r, g, b, a uint32) // function to get original image RGBA color values
+	pxRGBA func(i int) (r, g, b, a uint32) // function to get original image RGBA color values by point
 }
 
-type point struct{ x, y int32 }
+// point is the index of a pixel in row-major order within the image bounds,
+// or for histogram input, the index of a color.
+type point uint32
 type chValues []uint16
 type queue []*cluster
 
 type cluster struct {
-	px       []point // list of points in the cluster
-	widestCh int     // rgb const identifying axis with widest value range
+	px       []point     // list of points in the cluster
+	widestCh int         // rgb const identifying axis with widest value range
+	volume   uint64      // color volume, as represented by pixels
+	pop      int         // population, as total weight of points
+	priority float64     // priority for splitting, by Config.Priority
+	gamut    quant.Gamut // extents of colors, as represented by pixels
 	// limits of this cluster
 	minR, maxR uint32
 	minG, maxG uint32
@@ -101,29 +1017,125 @@ type cluster struct {
 
 // indentifiers for RGB channels, or dimensions or axes of RGB color space
 const (
-	rgbR = iota
-	rgbG
-	rgbB
+	rgbR = quant.AxisR
+	rgbG = quant.AxisG
+	rgbB = quant.AxisB
 )
 
-func newQuantizer(img image.Image, nq int) *quantizer {
+func newQuantizer(img image.Image, nq int, cf *Config) *quantizer {
 	if nq < 1 {
-		return &quantizer{img: img, pxRGBA: internal.PxRGBAfunc(img)}
+		return &quantizer{img: img, cf: cf, pxRGBA: internal.PxIndexRGBAfunc(img)}
 	}
 	b := img.Bounds()
 	npx := (b.Max.X - b.Min.X) * (b.Max.Y - b.Min.Y)
+	if npx <= 0 {
+		// no pixels, no clusters
+		return &quantizer{img: img, cf: cf, pxRGBA: internal.PxIndexRGBAfunc(img)}
+	}
 	qz := &quantizer{
 		img:    img,
 		ch:     make(chValues, npx),
 		cs:     make([]cluster, nq),
-		pxRGBA: internal.PxRGBAfunc(img),
+		cf:     cf,
+		pxRGBA: internal.CachedPxIndexRGBAfunc(img),
 	}
 	// Populate initial cluster with all pixels from image.
-	c := &qz.cs[0]
 	px := make([]point, npx)
+	for i := range px {
+		px[i] = point(i)
+	}
+	qz.initCluster(px)
+	return qz
+}
+
+// skip removes points from the initial cluster where f returns true for
+// the point color.  If no points remain, clusters are removed.
+func (qz *quantizer) skip(f func(r, g, b, a uint32) bool) {
+	if len(qz.cs) == 0 {
+		return
+	}
+	px := qz.cs[0].px[:0]
+	for _, p := range qz.cs[0].px {
+		if !f(qz.pxRGBA(int(p))) {
+			px = append(px, p)
+		}
+	}
+	if len(px) == 0 {
+		qz.cs = nil
+		return
+	}
+	qz.initCluster(px)
+}
+
+// newHistQuantizer constructs a quantizer for a color histogram rather
+// than an image.  Points represent colors, as indexes into colors and
+// counts.  Colors with counts < 1 are ignored.
+func newHistQuantizer(colors []color.Color, counts []int, nq int, cf *Config) *quantizer {
+	hc := make([]color.RGBA64, len(colors))
+	for i, c := range colors {
+		hc[i] = rgba64(c)
+	}
+	qz := &quantizer{
+		cf: cf,
+		wt: counts,
+		pxRGBA: func(i int) (r, g, b, a uint32) {
+			return hc[i].RGBA()
+		},
+	}
+	px := make([]point, 0, len(colors))
+	for i := range colors {
+		if counts[i] > 0 {
+			px = append(px, point(i))
+		}
+	}
+	if nq < 1 || len(px) == 0 {
+		return qz
+	}
+	qz.ch = make(chValues, len(px))
+	qz.cs = make([]cluster, nq)
+	qz.initCluster(px)
+	return qz
+}
+
+// initCluster populates the initial cluster with all points.
+func (qz *quantizer) initCluster(px []point) {
+	c := &qz.cs[0]
+	qz.initLimits(c, px)
+	qz.t.Root = c.node
+}
+
+// warmStart replaces the initial cluster with clusters of points nearest
+// each color of p.  Colors nearest no points get no cluster.
+func (qz *quantizer) warmStart(p color.Palette) {
+	if len(qz.cs) == 0 || len(qz.cs[0].px) == 0 {
+		return
+	}
+	lp := quant.LinearPalette{Palette: p}
+	parts := make([][]point, len(p))
+	for _, pt := range qz.cs[0].px {
+		r, g, b, a := qz.pxRGBA(int(pt))
+		i := lp.IndexNear(color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)})
+		parts[i] = append(parts[i], pt)
+	}
+	// reuse the point list of the initial cluster
+	px := qz.cs[0].px[:0]
+	qz.t.Root = nil
+	for _, part := range parts {
+		if len(part) == 0 {
+			continue
+		}
+		c := &qz.cs[len(qz.roots)]
+		px = append(px, part...)
+		qz.initLimits(c, px[len(px)-len(part):])
+		qz.roots = append(qz.roots, c.node)
+	}
+}
+
+// initLimits populates cluster c with points px and sets limits to the
+// extents of point colors.
+func (qz *quantizer) initLimits(c *cluster, px []point) {
 	c.px = px
 	c.node = &quant.Node{}
-	qz.t.Root = c.node
 	c.minR = math.MaxUint32
 	c.minG = math.MaxUint32
 	c.minB = math.MaxUint32
@@ -133,93 +1145,355 @@ func newQuantizer(img image.Image, nq int) *quantizer {
 	c.bMaxR = true
 	c.bMaxG = true
 	c.bMaxB = true
-	i := 0
-	for y := b.Min.Y; y < b.Max.Y; y++ {
-		for x := b.Min.X; x < b.Max.X; x++ {
-			px[i].x = int32(x)
-			px[i].y = int32(y)
-			r, g, b, _ := qz.pxRGBA(x, y)
-			if r < c.minR {
-				c.minR = r
-			}
-			if r > c.maxR {
-				c.maxR = r
-			}
-			if g < c.minG {
-				c.minG = g
+	for _, p := range px {
+		r, g, b, _ := qz.pxRGBA(int(p))
+		if r < c.minR {
+			c.minR = r
+		}
+		if r > c.maxR {
+			c.maxR = r
+		}
+		if g < c.minG {
+			c.minG = g
+		}
+		if g > c.maxG {
+			c.maxG = g
+		}
+		if b < c.minB {
+			c.minB = b
+		}
+		if b > c.maxB {
+			c.maxB = b
+		}
+	}
+}
+
+// weight returns the number of pixels represented by point p.
+func (qz *quantizer) weight(p point) int {
+	if qz.wt == nil {
+		return 1
+	}
+	return qz.wt[p]
+}
+
+// Cluster by repeatedly splitting clusters.
+// Terminate when the desired number of clusters has been populated
+// or when clusters cannot be further split.  Palette indexes and colors
+// are then set, even if no clusters were split.  There is nothing to do
+// if there are no clusters, as for an image with no pixels.
+func (qz *quantizer) cluster() {
+	if len(qz.cs) == 0 {
+		return
+	}
+	// number of clusters populated at the start
+	n0 := 1
+	if qz.roots != nil {
+		n0 = len(qz.roots)
+	}
+	if qz.cf.Budget > 0 {
+		qz.deadline = time.Now().Add(qz.cf.Budget)
+	}
+	i := n0 // number of clusters populated
+	if len(qz.cs) > n0 {
+		switch st := qz.cf.Split; st.(type) {
+		case nil, MedianCut:
+			i = qz.clusterMedian(n0)
+		default:
+			i = qz.clusterBy(st, n0)
+		}
+	}
+	qz.cs = qz.cs[:i]
+	if qz.roots == nil {
+		// set TreePalette total and indexes
+		qz.t.Leaves = i
+		qz.t.Walk(func(leaf *quant.Node, i int) { leaf.Index = i })
+	} else {
+		// number leaves of the trees of each warm start cluster in turn
+		x := 0
+		for _, r := range qz.roots {
+			quant.TreePalette{Root: r}.Walk(func(leaf *quant.Node, _ int) {
+				leaf.Index = x
+				x++
+			})
+		}
+	}
+	// compute palette colors
+	for i := range qz.cs {
+		c := &qz.cs[i]
+		if qz.cf.Representative == Mode {
+			c.node.Color = qz.mode(c.px)
+		} else {
+			c.node.Color = qz.mean(c.px)
+		}
+	}
+	if qz.cf.ExactDominant {
+		qz.snapDominant()
+	}
+	if qz.cf.MinLuminance > 0 || qz.cf.MaxLuminance > 0 {
+		for i := range qz.cs {
+			n := qz.cs[i].node
+			n.Color = qz.cf.lumBound(n.Color)
+		}
+	}
+}
+
+// lumBound returns c moved to within cf.MinLuminance and cf.MaxLuminance.
+func (cf *Config) lumBound(c color.RGBA64) color.RGBA64 {
+	// coefficients of color.GrayModel
+	w := [3]float64{19595. / 65536, 38470. / 65536, 7471. / 65536}
+	ch := [3]float64{float64(c.R), float64(c.G), float64(c.B)}
+	lum := func() float64 {
+		return w[0]*ch[0] + w[1]*ch[1] + w[2]*ch[2]
+	}
+	hi := float64(cf.MaxLuminance)
+	if cf.MaxLuminance == 0 {
+		hi = 0xffff
+	}
+	var target float64
+	switch l := lum(); {
+	case l < float64(cf.MinLuminance):
+		target = float64(cf.MinLuminance)
+	case l > hi:
+		target = hi
+	default:
+		return c
+	}
+	// shift channels not yet at a limit.  each pass either reaches the
+	// target or limits another channel.
+	for pass := 0; pass < 3; pass++ {
+		d := target - lum()
+		var wf float64 // weight of free channels
+		for i, v := range ch {
+			if d > 0 && v < 0xffff || d < 0 && v > 0 {
+				wf += w[i]
 			}
-			if g > c.maxG {
-				c.maxG = g
+		}
+		if math.Abs(d) < .5 || wf == 0 {
+			break
+		}
+		for i, v := range ch {
+			if d > 0 && v < 0xffff || d < 0 && v > 0 {
+				ch[i] = math.Max(0, math.Min(0xffff, v+d/wf))
 			}
-			if b < c.minB {
-				c.minB = b
+		}
+	}
+	return color.RGBA64{uint16(math.Round(ch[0])), uint16(math.Round(ch[1])),
+		uint16(math.Round(ch[2])), c.A}
+}
+
+// snapDominant sets the color of the cluster containing the most common
+// color of the image to exactly that color.  If pixels of that color are
+// in more than one cluster, as with BalanceTies, the cluster with the most
+// of them is used.
+func (qz *quantizer) snapDominant() {
+	rgba := func(p point) color.RGBA64 {
+		r, g, b, _ := qz.pxRGBA(int(p))
+		return color.RGBA64{uint16(r), uint16(g), uint16(b), 0xffff}
+	}
+	tally := map[color.RGBA64]int{}
+	var dom color.RGBA64
+	max := 0
+	for i := range qz.cs {
+		for _, p := range qz.cs[i].px {
+			c := rgba(p)
+			n := tally[c] + qz.weight(p)
+			tally[c] = n
+			if n > max {
+				dom, max = c, n
 			}
-			if b > c.maxB {
-				c.maxB = b
+		}
+	}
+	if max == 0 {
+		return
+	}
+	best := 0
+	max = 0
+	for i := range qz.cs {
+		n := 0
+		for _, p := range qz.cs[i].px {
+			if rgba(p) == dom {
+				n += qz.weight(p)
 			}
-			i++
+		}
+		if n > max {
+			best, max = i, n
 		}
 	}
-	return qz
+	qz.cs[best].node.Color = dom
 }
 
-// Cluster by repeatedly splitting clusters.
-// Use a heap as priority queue for picking clusters to split.
-// The rule is to spilt the cluster with the most pixels.
-// Terminate when the desired number of clusters has been populated
-// or when clusters cannot be further split.
-func (qz *quantizer) cluster() {
+// overBudget returns true if the time of Config.Budget has passed.
+func (qz *quantizer) overBudget() bool {
+	return !qz.deadline.IsZero() && time.Now().After(qz.deadline)
+}
+
+// clusterMedian clusters using a heap as priority queue for picking
+// clusters to split.  The rule by default is to spilt the cluster with the
+// most pixels.  Argument n0 is the number of clusters initially populated.
+// It returns the number of clusters populated.
+func (qz *quantizer) clusterMedian(n0 int) int {
 	pq := new(queue)
-	// Initial cluster.  populated at this point, but not analyzed.
+	// Initial clusters.  populated at this point, but not analyzed.
+	for x := 1; x < n0; x++ {
+		if c := &qz.cs[x]; qz.scan(c) {
+			heap.Push(pq, c)
+		}
+	}
 	c := &qz.cs[0]
 	var m uint32
-	i := 1
+	i := n0
 	for {
 		// Only enqueue clusters that can be split.
-		if qz.setWidestChannel(c) {
+		if qz.scan(c) {
 			heap.Push(pq, c)
 		}
-		// If no clusters have any color variation, mark the end of the
-		// cluster list and quit early.
+		// If no clusters have any color variation, quit early.
 		if len(*pq) == 0 {
-			qz.cs = qz.cs[:i]
-			break
+			return i
 		}
 		s := heap.Pop(pq).(*cluster) // get cluster to split
+		t0 := qz.start()
 		m = qz.medianCut(s)
+		qz.stop(cutPhase, t0)
 		c = &qz.cs[i] // set c to new cluster
 		i++
-		qz.split(s, c, m) // split s into c and s at value m
+		qz.timedSplit(s, c, m) // split s into c and s at value m
 		// Normal exit is when all clusters are populated.
-		if i == len(qz.cs) {
-			break
+		if i == len(qz.cs) || qz.overBudget() {
+			return i
 		}
-		if qz.setWidestChannel(s) {
+		if qz.scan(s) {
 			heap.Push(pq, s) // return s to queue
 		}
 	}
-	// set TreePalette total and indexes
-	qz.t.Leaves = i
-	qz.t.Walk(func(leaf *quant.Node, i int) { leaf.Index = i })
-	// compute palette colors
-	for i := range qz.cs {
-		px := qz.cs[i].px
-		// Average values in cluster to get palette color.
-		var rsum, gsum, bsum int64
-		for _, p := range px {
-			r, g, b, _ := qz.pxRGBA(int(p.x), int(p.y))
-			rsum += int64(r)
-			gsum += int64(g)
-			bsum += int64(b)
+}
+
+// clusterBy clusters with SplitStrategy st picking clusters to split and
+// cut values.  Argument n0 is the number of clusters initially populated.
+// It returns the number of clusters populated.
+func (qz *quantizer) clusterBy(st SplitStrategy, n0 int) int {
+	var cand []*Cluster // clusters that can be split
+	for x := 1; x < n0; x++ {
+		if c := &qz.cs[x]; qz.scan(c) {
+			cand = append(cand, qz.view(c))
 		}
-		n64 := int64(len(px))
-		qz.cs[i].node.Color = color.RGBA64{
-			uint16(rsum / n64),
-			uint16(gsum / n64),
-			uint16(bsum / n64),
-			0xffff,
+	}
+	c := &qz.cs[0]
+	i := n0
+	for {
+		if qz.scan(c) {
+			cand = append(cand, qz.view(c))
+		}
+		if len(cand) == 0 {
+			return i
+		}
+		x := st.SelectCluster(cand)
+		v := cand[x]
+		cand = append(cand[:x], cand[x+1:]...)
+		// keep cut within the value range so that neither part is empty.
+		t0 := qz.start()
+		m := st.CutValue(v)
+		qz.stop(cutPhase, t0)
+		if lo, hi := v.Range(); m <= lo {
+			m = lo + 1
+		} else if m > hi {
+			m = hi
+		}
+		c = &qz.cs[i]
+		i++
+		qz.timedSplit(v.c, c, m)
+		if i == len(qz.cs) || qz.overBudget() {
+			return i
+		}
+		if qz.scan(v.c) {
+			cand = append(cand, qz.view(v.c))
+		}
+	}
+}
+
+// Phases of clustering timed by Config.Timing.
+const (
+	scanPhase = iota
+	cutPhase
+	splitPhase
+)
+
+// start returns the start time of a phase timed by Config.Timing, or the
+// zero time if Timing is nil.
+func (qz *quantizer) start() time.Time {
+	if qz.cf.Timing == nil {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+// stop adds the time since t0 to the phase of Config.Timing.
+func (qz *quantizer) stop(phase int, t0 time.Time) {
+	t := qz.cf.Timing
+	if t == nil {
+		return
+	}
+	d := time.Since(t0)
+	switch phase {
+	case scanPhase:
+		t.Scan += d
+	case cutPhase:
+		t.Cut += d
+	default:
+		t.Split += d
+	}
+}
+
+// scan is setWidestChannel, timed as a scan phase.
+func (qz *quantizer) scan(c *cluster) bool {
+	t0 := qz.start()
+	ok := qz.setWidestChannel(c)
+	qz.stop(scanPhase, t0)
+	return ok
+}
+
+// timedSplit is split, timed as a split phase.
+func (qz *quantizer) timedSplit(s, c *cluster, m uint32) {
+	t0 := qz.start()
+	qz.split(s, c, m)
+	qz.stop(splitPhase, t0)
+}
+
+// mean returns the average color of points px.
+func (qz *quantizer) mean(px []point) color.RGBA64 {
+	var rsum, gsum, bsum, n64 int64
+	for _, p := range px {
+		r, g, b, _ := qz.pxRGBA(int(p))
+		w := int64(qz.weight(p))
+		rsum += int64(r) * w
+		gsum += int64(g) * w
+		bsum += int64(b) * w
+		n64 += w
+	}
+	return color.RGBA64{
+		uint16(rsum / n64),
+		uint16(gsum / n64),
+		uint16(bsum / n64),
+		0xffff,
+	}
+}
+
+// mode returns the most populous exact color of points px.  Of colors
+// with equal population, the one first reaching that population wins.
+func (qz *quantizer) mode(px []point) color.RGBA64 {
+	tally := map[color.RGBA64]int{}
+	var best color.RGBA64
+	max := 0
+	for _, p := range px {
+		r, g, b, _ := qz.pxRGBA(int(p))
+		c := color.RGBA64{uint16(r), uint16(g), uint16(b), 0xffff}
+		n := tally[c] + qz.weight(p)
+		tally[c] = n
+		if n > max {
+			best, max = c, n
 		}
 	}
+	return best
 }
 
 func (q *quantizer) setWidestChannel(c *cluster) bool {
@@ -230,8 +1504,24 @@ func (q *quantizer) setWidestChannel(c *cluster) bool {
 	minR := uint32(math.MaxUint32)
 	minG := uint32(math.MaxUint32)
 	minB := uint32(math.MaxUint32)
+	pop := 0
+	variance := q.cf.Channel == GreatestVariance
+	// weighted sums and sums of squares of values, for GreatestVariance
+	var sum, sq [3]float64
 	for _, p := range c.px {
-		r, g, b, _ := q.pxRGBA(int(p.x), int(p.y))
+		r, g, b, _ := q.pxRGBA(int(p))
+		w := q.weight(p)
+		pop += w
+		if variance {
+			for ch, v := range [3]uint32{r, g, b} {
+				f := float64(v)
+				if q.cf.Linear {
+					f = internal.ToLinear(v) * 0xffff
+				}
+				sum[ch] += float64(w) * f
+				sq[ch] += float64(w) * f * f
+			}
+		}
 		if r < minR {
 			minR = r
 		}
@@ -252,20 +1542,79 @@ func (q *quantizer) setWidestChannel(c *cluster) bool {
 		}
 	}
 	// See which color dimension had the widest range.
+	dR := float64(maxR - minR)
+	dG := float64(maxG - minG)
+	dB := float64(maxB - minB)
+	if q.cf.Linear {
+		dR = (internal.ToLinear(maxR) - internal.ToLinear(minR)) * 0xffff
+		dG = (internal.ToLinear(maxG) - internal.ToLinear(minG)) * 0xffff
+		dB = (internal.ToLinear(maxB) - internal.ToLinear(minB)) * 0xffff
+	}
 	c.widestCh = rgbG
-	min := minG
-	max := maxG
-	if maxR-minR > max-min {
+	w := dG
+	if dR > w {
 		c.widestCh = rgbR
-		min = minR
-		max = maxR
+		w = dR
 	}
-	if maxB-minB > max-min {
+	if dB > w {
+		c.widestCh = rgbB
+		w = dB
+	}
+	if variance && w > 0 {
+		// channel of greatest variance.  the population is the same for
+		// each channel so comparing pop² × variance is sufficient.
+		maxV := -1.
+		for ch, d := range [3]float64{dR, dG, dB} {
+			if v := float64(pop)*sq[ch] - sum[ch]*sum[ch]; d > 0 && v > maxV {
+				c.widestCh, maxV = ch, v
+			}
+		}
+	}
+	c.gamut = quant.Gamut{
+		Min: color.RGBA64{uint16(minR), uint16(minG), uint16(minB), 0xffff},
+		Max: color.RGBA64{uint16(maxR), uint16(maxG), uint16(maxB), 0xffff},
+	}
+	if q.cf.HybridChroma > 0 && w > 0 {
+		q.labChannel(c)
+	}
+	c.volume = uint64(dR * dG * dB)
+	c.pop = pop
+	c.priority = float64(pop)
+	if q.cf.Priority == PopulationVolume {
+		c.priority *= float64(c.volume)
+	}
+	return w > 0
+}
+
+// labChannel sets c.widestCh by L*a*b* color difference if the center of
+// gamut c.gamut has chroma below cf.HybridChroma.
+func (q *quantizer) labChannel(c *cluster) {
+	lo, hi := c.gamut.Min, c.gamut.Max
+	mid := [3]uint32{
+		(uint32(lo.R) + uint32(hi.R)) / 2,
+		(uint32(lo.G) + uint32(hi.G)) / 2,
+		(uint32(lo.B) + uint32(hi.B)) / 2,
+	}
+	if _, a, b := internal.Lab(mid[0], mid[1], mid[2]); math.Hypot(a, b) >= q.cf.HybridChroma {
+		return
+	}
+	// color difference of the channel range at the center color
+	dE := func(ch int, min, max uint16) float64 {
+		c0, c1 := mid, mid
+		c0[ch], c1[ch] = uint32(min), uint32(max)
+		l0, a0, b0 := internal.Lab(c0[0], c0[1], c0[2])
+		l1, a1, b1 := internal.Lab(c1[0], c1[1], c1[2])
+		return math.Sqrt((l1-l0)*(l1-l0) + (a1-a0)*(a1-a0) + (b1-b0)*(b1-b0))
+	}
+	c.widestCh = rgbG
+	w := dE(rgbG, lo.G, hi.G)
+	if d := dE(rgbR, lo.R, hi.R); d > w {
+		c.widestCh = rgbR
+		w = d
+	}
+	if d := dE(rgbB, lo.B, hi.B); d > w {
 		c.widestCh = rgbB
-		min = minB
-		max = maxB
 	}
-	return max > min
 }
 
 // Arg c must have value range > 0 in dimension c.widestDim.
@@ -279,23 +1628,30 @@ func (q *quantizer) medianCut(c *cluster) uint32 {
 	switch c.widestCh {
 	case rgbR:
 		for i, p := range c.px {
-			r, _, _, _ := q.pxRGBA(int(p.x), int(p.y))
+			r, _, _, _ := q.pxRGBA(int(p))
 			ch[i] = uint16(r)
 		}
 	case rgbG:
 		for i, p := range c.px {
-			_, g, _, _ := q.pxRGBA(int(p.x), int(p.y))
+			_, g, _, _ := q.pxRGBA(int(p))
 			ch[i] = uint16(g)
 		}
 	case rgbB:
 		for i, p := range c.px {
-			_, _, b, _ := q.pxRGBA(int(p.x), int(p.y))
+			_, _, b, _ := q.pxRGBA(int(p))
 			ch[i] = uint16(b)
 		}
 	}
 	// Find cut.
+	if q.wt != nil {
+		sort.Sort(chPoints{ch, px})
+		return q.weightedCut(ch, px)
+	}
 	sort.Sort(ch)
 	m1 := len(ch) / 2 // median
+	if q.cf.BalanceTies {
+		return uint32(ch[m1]) // split will balance ties
+	}
 	if ch[m1] != ch[m1-1] {
 		return uint32(ch[m1])
 	}
@@ -313,6 +1669,43 @@ func (q *quantizer) medianCut(c *cluster) uint32 {
 	return uint32(ch[m2])
 }
 
+// weightedCut is medianCut for weighted points.  Values ch and points px
+// must be sorted together.  The cut is the same as medianCut would compute
+// with each point replicated by its weight.
+func (q *quantizer) weightedCut(ch chValues, px []point) uint32 {
+	total := 0
+	for _, p := range px {
+		total += q.weight(p)
+	}
+	// Find point i representing the median pixel k.
+	k := total / 2
+	i, cum := 0, 0
+	for cum+q.weight(px[i]) <= k {
+		cum += q.weight(px[i])
+		i++
+	}
+	if q.cf.BalanceTies || cum == k && ch[i] != ch[i-1] {
+		return uint32(ch[i])
+	}
+	// Find run of points [a, b) with the median value, and pixel counts
+	// pa to the left, pb through the end of the run.
+	a, pa := i, cum
+	for a > 0 && ch[a-1] == ch[i] {
+		a--
+		pa -= q.weight(px[a])
+	}
+	b, pb := i+1, cum+q.weight(px[i])
+	for b < len(ch) && ch[b] == ch[i] {
+		pb += q.weight(px[b])
+		b++
+	}
+	// Return value that makes more equitable cut.
+	if pa > total-pb {
+		return uint32(ch[a])
+	}
+	return uint32(ch[b])
+}
+
 // split s into c and s at value m
 func (q *quantizer) split(s, c *cluster, m uint32) {
 	*c = *s // copy extent data
@@ -320,9 +1713,13 @@ func (q *quantizer) split(s, c *cluster, m uint32) {
 	var v uint32
 	i := 0
 	last := len(px) - 1
+	if q.cf.Locality && q.wt == nil {
+		i = q.stableSplit(px, s.widestCh, m)
+		last = i - 1 // skip swapping
+	}
 	for i <= last {
 		// Get color value in appropriate dimension.
-		r, g, b, _ := q.pxRGBA(int(px[i].x), int(px[i].y))
+		r, g, b, _ := q.pxRGBA(int(px[i]))
 		switch s.widestCh {
 		case rgbR:
 			v = r
@@ -339,6 +1736,9 @@ func (q *quantizer) split(s, c *cluster, m uint32) {
 			last--
 		}
 	}
+	if q.cf.BalanceTies {
+		i = q.balanceTies(px, i, s.widestCh, m)
+	}
 	// Split the pixel list.  s keeps smaller values, c gets larger values.
 	s.px = px[:i]
 	c.px = px[i:]
@@ -371,28 +1771,135 @@ func (q *quantizer) split(s, c *cluster, m uint32) {
 	s.node, c.node = n.Low, n.High
 }
 
+// balanceTies partitions px[i:], points with values >= m in channel ch,
+// into points equal to m followed by points greater than m.  It returns
+// a cut index that divides the points equal to m to balance pixel counts
+// of px[:cut] and px[cut:].  Both parts are non-empty.
+func (q *quantizer) balanceTies(px []point, i, ch int, m uint32) int {
+	j := i
+	last := len(px) - 1
+	for j <= last {
+		if q.chValue(px[j], ch) == m {
+			j++
+		} else {
+			px[last], px[j] = px[j], px[last]
+			last--
+		}
+	}
+	// px[i:j] now holds ties.
+	total, low := 0, 0
+	for x, p := range px {
+		w := q.weight(p)
+		total += w
+		if x < i {
+			low += w
+		}
+	}
+	cut := i
+	for ; cut < j && cut < len(px)-1 && 2*low < total; cut++ {
+		low += q.weight(px[cut])
+	}
+	if cut == 0 {
+		cut = 1
+	}
+	return cut
+}
+
+// stableSplit partitions px so that points with channel ch values < m
+// come first, keeping the relative order of points in both parts.  It
+// returns the number of points < m.
+func (q *quantizer) stableSplit(px []point, ch int, m uint32) int {
+	if len(q.buf) < len(px) {
+		q.buf = make([]point, len(px))
+	}
+	hi := q.buf[:0]
+	i := 0
+	for _, p := range px {
+		if q.chValue(p, ch) < m {
+			px[i] = p
+			i++
+		} else {
+			hi = append(hi, p)
+		}
+	}
+	copy(px[i:], hi)
+	return i
+}
+
+// chValue returns the value of channel ch of the color of point p.
+func (q *quantizer) chValue(p point, ch int) uint32 {
+	r, g, b, _ := q.pxRGBA(int(p))
+	switch ch {
+	case rgbR:
+		return r
+	case rgbG:
+		return g
+	}
+	return b
+}
+
+// palette returns the palette of clusters, a TreePalette unless clusters
+// were started with WarmStart.
+func (qz *quantizer) palette() quant.Palette {
+	if qz.roots == nil {
+		return qz.t
+	}
+	cp := make(color.Palette, len(qz.cs))
+	for i := range qz.cs {
+		n := qz.cs[i].node
+		cp[n.Index] = n.Color
+	}
+	return quant.LinearPalette{Palette: cp}
+}
+
 func (qz *quantizer) paletted() *image.Paletted {
-	cp := qz.t.ColorPalette()
+	cp := qz.palette().ColorPalette()
 	pi := image.NewPaletted(qz.img.Bounds(), cp)
 	for i := range qz.cs {
 		x := uint8(qz.cs[i].node.Index)
 		for _, p := range qz.cs[i].px {
-			pi.SetColorIndex(int(p.x), int(p.y), x)
+			pi.Pix[p] = x
 		}
 	}
 	return pi
 }
 
+// indexed generates a wide index image from clusters, with palette cp.
+// Cluster indexes are offset by i0.
+func (qz *quantizer) indexed(cp color.Palette, i0 int) *quant.IndexedImage {
+	ii := quant.NewIndexedImage(qz.img.Bounds(), cp)
+	for i := range qz.cs {
+		x := uint16(qz.cs[i].node.Index + i0)
+		for _, p := range qz.cs[i].px {
+			ii.Pix[p] = x
+		}
+	}
+	return ii
+}
+
 // Implement sort.Interface for sort in median algorithm.
 func (c chValues) Len() int           { return len(c) }
 func (c chValues) Less(i, j int) bool { return c[i] < c[j] }
 func (c chValues) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
 
+// chPoints sorts points along with their channel values.
+type chPoints struct {
+	ch chValues
+	px []point
+}
+
+func (c chPoints) Len() int           { return len(c.ch) }
+func (c chPoints) Less(i, j int) bool { return c.ch[i] < c.ch[j] }
+func (c chPoints) Swap(i, j int) {
+	c.ch[i], c.ch[j] = c.ch[j], c.ch[i]
+	c.px[i], c.px[j] = c.px[j], c.px[i]
+}
+
 // Implement heap.Interface for priority queue of clusters.
 func (q queue) Len() int { return len(q) }
 
-// Priority is number of pixels in cluster.
-func (q queue) Less(i, j int) bool { return len(q[i].px) > len(q[j].px) }
+// Priority is computed by setWidestChannel.
+func (q queue) Less(i, j int) bool { return q[i].priority > q[j].priority }
 func (q queue) Swap(i, j int) {
 	q[i], q[j] = q[j], q[i]
 }
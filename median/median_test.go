@@ -1,15 +1,24 @@
 package median_test
 
 import (
+	"bytes"
+	"flag"
 	"fmt"
 	"image"
+	"image/color"
+	"image/draw"
 	"image/png"
+	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"testing"
+	"time"
 
 	"github.com/soniakeys/quant"
+	"github.com/soniakeys/quant/internal/testimage"
 	"github.com/soniakeys/quant/median"
 )
 
@@ -89,3 +98,1130 @@ func BenchmarkPalette(b *testing.B) {
 		q.Palette(img)
 	}
 }
+
+// BenchmarkLocality compares clustering a large image with and without
+// Config.Locality.
+func BenchmarkLocality(b *testing.B) {
+	// a noisy photo-like image, large enough that pixel reads in scrambled
+	// order miss the cache
+	img := image.NewRGBA(image.Rect(0, 0, 2048, 2048))
+	src := testimage.Synthetic()
+	sb := src.Bounds()
+	rnd := rand.New(rand.NewSource(1))
+	for y := 0; y < 2048; y++ {
+		for x := 0; x < 2048; x++ {
+			r, g, bl, _ := src.At(sb.Min.X+x*sb.Dx()/2048, sb.Min.Y+y*sb.Dy()/2048).RGBA()
+			n := uint8(rnd.Intn(16))
+			img.SetRGBA(x, y, color.RGBA{uint8(r>>8) ^ n, uint8(g>>8) ^ n, uint8(bl>>8) ^ n, 255})
+		}
+	}
+	for _, loc := range []bool{false, true} {
+		b.Run(fmt.Sprint("Locality=", loc), func(b *testing.B) {
+			cf := median.Config{N: 256, Locality: loc}
+			for i := 0; i < b.N; i++ {
+				cf.Palette(img)
+			}
+		})
+	}
+}
+
+var update = flag.Bool("update", false, "update golden files in testdata")
+
+// TestGolden quantizes a synthetic image generated in code and compares
+// the resulting palette and pixel indices with golden files in testdata.
+// Run with -update to regenerate the golden files after an intended change
+// in results.
+func TestGolden(t *testing.T) {
+	img := testimage.Synthetic()
+	for _, n := range []int{16, 256} {
+		got := golden(median.Quantizer(n).Paletted(img))
+		fn := filepath.Join("testdata", fmt.Sprintf("synthetic_%d.golden", n))
+		if *update {
+			if err := ioutil.WriteFile(fn, got, 0666); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("n = %d: result differs from %s", n, fn)
+		}
+	}
+}
+
+// golden formats a paletted image as text, one line per palette color
+// followed by one line of hex indices per row of pixels.
+func golden(pi *image.Paletted) []byte {
+	var b bytes.Buffer
+	for _, c := range pi.Palette {
+		r, g, bl, a := c.RGBA()
+		fmt.Fprintf(&b, "%04x %04x %04x %04x\n", r, g, bl, a)
+	}
+	r := pi.Bounds()
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		i := pi.PixOffset(r.Min.X, y)
+		fmt.Fprintf(&b, "%x\n", pi.Pix[i:i+r.Dx()])
+	}
+	return b.Bytes()
+}
+
+// TestQuantizeHistogram tests that quantizing a histogram of an image
+// gives the same palette as quantizing the image.
+func TestQuantizeHistogram(t *testing.T) {
+	img := testimage.Synthetic()
+	x := map[color.NRGBA]int{}
+	var colors []color.Color
+	var counts []int
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x0 := b.Min.X; x0 < b.Max.X; x0++ {
+			c := img.NRGBAAt(x0, y)
+			i, ok := x[c]
+			if !ok {
+				i = len(colors)
+				x[c] = i
+				colors = append(colors, c)
+				counts = append(counts, 0)
+			}
+			counts[i]++
+		}
+	}
+	for _, n := range []int{16, 256} {
+		want := median.Quantizer(n).Palette(img).ColorPalette()
+		got := median.QuantizeHistogram(colors, counts, n).ColorPalette()
+		if len(got) != len(want) {
+			t.Fatalf("n = %d: got %d colors, want %d", n, len(got), len(want))
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Fatalf("n = %d: color %d = %v, want %v",
+					n, i, got[i], want[i])
+			}
+		}
+	}
+}
+
+func TestHistogrammer(t *testing.T) {
+	img := testimage.Synthetic()
+	var h median.Histogrammer
+	h.Add(img)
+	h.Add(img)
+	colors, counts := h.Histogram()
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	b := img.Bounds()
+	if want := 2 * b.Dx() * b.Dy(); total != want {
+		t.Fatalf("total count %d, want %d", total, want)
+	}
+	if len(colors) != len(counts) {
+		t.Fatalf("%d colors, %d counts", len(colors), len(counts))
+	}
+	if n := h.Palette(16).Len(); n != 16 {
+		t.Fatalf("palette has %d colors, want 16", n)
+	}
+	// pixels are counted by Add, so later changes to an image don't count
+	var h2 median.Histogrammer
+	if c, _ := h2.Histogram(); len(c) != 0 {
+		t.Fatalf("empty Histogrammer has %d colors", len(c))
+	}
+	cp := image.NewNRGBA(b)
+	copy(cp.Pix, img.Pix)
+	h2.Add(cp)
+	h2.Add(img)
+	for i := range cp.Pix {
+		cp.Pix[i] = 0
+	}
+	if c2, n2 := h2.Histogram(); !reflect.DeepEqual(c2, colors) || !reflect.DeepEqual(n2, counts) {
+		t.Fatal("histogram changed with image after Add")
+	}
+}
+
+// TestGamuts tests that each palette color is within its gamut.
+func TestGamuts(t *testing.T) {
+	img := testimage.Synthetic()
+	q := median.Quantizer(16)
+	p := q.Palette(img).ColorPalette()
+	g := q.Gamuts(img)
+	if len(g) != len(p) {
+		t.Fatalf("%d gamuts, %d colors", len(g), len(p))
+	}
+	for i, c := range p {
+		r, gr, b, _ := c.RGBA()
+		min, max := g[i].Min, g[i].Max
+		if r < uint32(min.R) || r > uint32(max.R) ||
+			gr < uint32(min.G) || gr > uint32(max.G) ||
+			b < uint32(min.B) || b > uint32(max.B) {
+			t.Errorf("color %d %v outside gamut %v", i, c, g[i])
+		}
+	}
+}
+
+// TestBalanceTies tests splitting a spike distribution at the median.
+func TestBalanceTies(t *testing.T) {
+	// 100 gray pixels: 10 black, 80 mid gray, 10 white.
+	img := image.NewGray(image.Rect(0, 0, 100, 1))
+	for x := range img.Pix {
+		switch {
+		case x < 10:
+			img.Pix[x] = 0
+		case x < 90:
+			img.Pix[x] = 128
+		default:
+			img.Pix[x] = 255
+		}
+	}
+	sizes := func(pi *image.Paletted) (n [2]int) {
+		for _, x := range pi.Pix {
+			n[x]++
+		}
+		return
+	}
+	if n := sizes(median.Quantizer(2).Paletted(img)); n[0] != 90 || n[1] != 10 {
+		t.Errorf("default: cluster sizes %v, want [90 10]", n)
+	}
+	cf := median.Config{N: 2, BalanceTies: true}
+	if n := sizes(cf.Paletted(img)); n[0] != 50 || n[1] != 50 {
+		t.Errorf("BalanceTies: cluster sizes %v, want [50 50]", n)
+	}
+}
+
+func TestTwoPass(t *testing.T) {
+	img := testimage.Synthetic()
+	pi := median.Config{N: 16, TwoPass: true}.Paletted(img)
+	if len(pi.Palette) != 16 {
+		t.Fatalf("%d colors, want 16", len(pi.Palette))
+	}
+	if pi.Bounds() != img.Bounds() {
+		t.Fatalf("bounds %v, want %v", pi.Bounds(), img.Bounds())
+	}
+	for _, x := range pi.Pix {
+		if int(x) >= len(pi.Palette) {
+			t.Fatalf("index %d out of range", x)
+		}
+	}
+}
+
+func TestRamps(t *testing.T) {
+	img := testimage.Synthetic()
+	ramp := []color.Color{
+		color.RGBA{0, 0, 0x40, 0xff},
+		color.RGBA{0, 0, 0x80, 0xff},
+		color.RGBA{0, 0, 0xc0, 0xff},
+	}
+	cf := median.Config{N: 16, Ramps: [][]color.Color{ramp}}
+	p := cf.Palette(img).ColorPalette()
+	if len(p) != 16 {
+		t.Fatalf("%d colors, want 16", len(p))
+	}
+	for i, c := range ramp {
+		if p[i] != c {
+			t.Errorf("palette color %d = %v, want %v", i, p[i], c)
+		}
+	}
+}
+
+func TestGray(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 64, 4))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i)
+	}
+	pi := median.Config{N: 16, Gray: true}.Paletted(img)
+	if len(pi.Palette) != 16 {
+		t.Fatalf("%d colors, want 16", len(pi.Palette))
+	}
+	for i, c := range pi.Palette {
+		if _, ok := c.(color.Gray); !ok {
+			t.Fatalf("palette color %d is %T, want color.Gray", i, c)
+		}
+	}
+}
+
+func TestAlphaThreshold(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for i := 0; i < len(img.Pix); i += 4 {
+		if i%8 == 0 {
+			continue // transparent
+		}
+		img.Pix[i] = uint8(i)
+		img.Pix[i+1] = 0x80
+		img.Pix[i+3] = 0xff
+	}
+	pi := median.Config{N: 8, AlphaThreshold: 0x8000}.Paletted(img)
+	if len(pi.Palette) != 8 {
+		t.Fatalf("%d colors, want 8", len(pi.Palette))
+	}
+	if _, _, _, a := pi.Palette[0].RGBA(); a != 0 {
+		t.Fatalf("color 0 not transparent")
+	}
+	for i, x := range pi.Pix {
+		if transparent := i%2 == 0; transparent != (x == 0) {
+			t.Fatalf("pixel %d: index %d", i, x)
+		}
+	}
+}
+
+func TestInverseFrequency(t *testing.T) {
+	// foliage of 32 greens, each 128 pixels, and a red berry of 4 pixels
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.Set(x, y, color.RGBA{uint8(x / 16 * 16), uint8(y / 8 * 32), 0x20, 0xff})
+		}
+	}
+	berry := color.RGBA{0xe0, 0x20, 0x20, 0xff}
+	img.Set(30, 30, berry)
+	img.Set(31, 30, berry)
+	img.Set(30, 31, berry)
+	img.Set(31, 31, berry)
+	// distance from berry to the palette color it maps to
+	dist := func(cf median.Config) int {
+		pi := cf.Paletted(img)
+		r, g, b, _ := pi.Palette[pi.ColorIndexAt(30, 30)].RGBA()
+		dr, dg, db := int(r>>8)-0xe0, int(g>>8)-0x20, int(b>>8)-0x20
+		return dr*dr + dg*dg + db*db
+	}
+	d0 := dist(median.Config{N: 8})
+	d1 := dist(median.Config{N: 8, InverseFrequency: 128})
+	if d1 >= d0 {
+		t.Fatalf("berry distance %d with InverseFrequency, %d without", d1, d0)
+	}
+}
+
+func TestMode(t *testing.T) {
+	// three colors in one cluster, the middle one most populous, and white
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	dominant := color.RGBA{0x80, 0x40, 0x20, 0xff}
+	for y := 0; y < 4; y++ {
+		for x := 0; x < 4; x++ {
+			switch {
+			case y == 0 && x < 2:
+				img.Set(x, y, color.RGBA{0x70, 0x40, 0x20, 0xff})
+			case y == 0:
+				img.Set(x, y, color.RGBA{0x98, 0x40, 0x20, 0xff})
+			case y == 3:
+				// leave white
+			default:
+				img.Set(x, y, dominant)
+			}
+		}
+	}
+	pi := median.Config{N: 2, Representative: median.Mode}.Paletted(img)
+	if len(pi.Palette) != 2 {
+		t.Fatalf("%d colors, want 2", len(pi.Palette))
+	}
+	c := pi.Palette[pi.ColorIndexAt(0, 0)]
+	if r, g, b, _ := c.RGBA(); r>>8 != 0x80 || g>>8 != 0x40 || b>>8 != 0x20 {
+		t.Fatalf("got %v, want %v", c, dominant)
+	}
+}
+
+func TestRGBAImage(t *testing.T) {
+	img := testimage.Synthetic()
+	for _, cf := range []median.Config{
+		{N: 16},
+		{N: 16, TwoPass: true},
+		{N: 16, AlphaThreshold: 0x8000},
+	} {
+		pi := cf.Paletted(img)
+		ni := cf.RGBAImage(img)
+		if ni.Rect != pi.Rect {
+			t.Fatalf("%+v: bounds %v, want %v", cf, ni.Rect, pi.Rect)
+		}
+		for y := pi.Rect.Min.Y; y < pi.Rect.Max.Y; y++ {
+			for x := pi.Rect.Min.X; x < pi.Rect.Max.X; x++ {
+				want := color.NRGBAModel.Convert(pi.At(x, y))
+				if got := ni.At(x, y); got != want {
+					t.Fatalf("%+v: pixel %d,%d = %v, want %v",
+						cf, x, y, got, want)
+				}
+			}
+		}
+	}
+}
+
+// meanCut is a SplitStrategy cutting the most populous cluster at its
+// mean value.
+type meanCut struct{}
+
+func (meanCut) SelectCluster(cs []*median.Cluster) int {
+	x := 0
+	for i, c := range cs {
+		if c.Population > cs[x].Population {
+			x = i
+		}
+	}
+	return x
+}
+
+func (meanCut) CutValue(c *median.Cluster) uint32 {
+	var sum, n uint64
+	c.Values(func(v uint32, w int) {
+		sum += uint64(v) * uint64(w)
+		n += uint64(w)
+	})
+	return uint32(sum / n)
+}
+
+func TestSplitStrategy(t *testing.T) {
+	img := testimage.Synthetic()
+	for _, n := range []int{16, 256} {
+		want := median.Config{N: n}.Palette(img).ColorPalette()
+		got := median.Config{N: n, Split: median.MedianCut{}}.
+			Palette(img).ColorPalette()
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("N %d: MedianCut palette differs from default", n)
+		}
+	}
+	// embedding runs MedianCut methods rather than the priority queue
+	want := median.Config{N: 16}.Palette(img).ColorPalette()
+	got := median.Config{N: 16, Split: struct{ median.MedianCut }{}}.
+		Palette(img).ColorPalette()
+	if !reflect.DeepEqual(got, want) {
+		t.Fatal("MedianCut methods palette differs from default")
+	}
+	pi := median.Config{N: 16, Split: meanCut{}}.Paletted(img)
+	if len(pi.Palette) != 16 {
+		t.Fatalf("meanCut: %d colors, want 16", len(pi.Palette))
+	}
+}
+
+func TestWorking(t *testing.T) {
+	img := testimage.Synthetic()
+	// identity transform gives default results
+	id := func(c color.Color) color.Color { return c }
+	want := median.Quantizer(16).Paletted(img)
+	got := median.Config{N: 16, ToWorking: id, FromWorking: id}.Paletted(img)
+	if !bytes.Equal(got.Pix, want.Pix) ||
+		!reflect.DeepEqual(got.Palette, want.Palette) {
+		t.Fatal("identity transform changed results")
+	}
+	// inverted working space
+	inv := func(c color.Color) color.Color {
+		r, g, b, a := c.RGBA()
+		return color.RGBA64{uint16(a - r), uint16(a - g), uint16(a - b), uint16(a)}
+	}
+	cf := median.Config{N: 16, ToWorking: inv, FromWorking: inv}
+	pi, p := cf.ImageAndPalette(img)
+	var e0, e1 uint64 // total error, default and inverted
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := img.At(x, y)
+			if i := p.IndexNear(c); i != int(pi.ColorIndexAt(x, y)) {
+				t.Fatalf("pixel %d,%d: IndexNear %d, image %d",
+					x, y, i, pi.ColorIndexAt(x, y))
+			}
+			e0 += testimage.SqDiff(c, want.At(x, y))
+			e1 += testimage.SqDiff(c, pi.At(x, y))
+		}
+	}
+	if e1 > e0*3/2 {
+		t.Fatalf("error %d in inverted space, %d by default", e1, e0)
+	}
+}
+
+func TestWarmStart(t *testing.T) {
+	img := testimage.Synthetic()
+	coarse := median.Quantizer(16).Palette(img).ColorPalette()
+	cf := median.Config{N: 64, WarmStart: coarse}
+	pi, p := cf.ImageAndPalette(img)
+	if len(pi.Palette) != 64 || p.Len() != 64 {
+		t.Fatalf("%d colors, palette Len %d, want 64", len(pi.Palette), p.Len())
+	}
+	// pixels stay in clusters of their warm start color
+	lp := quant.LinearPalette{Palette: coarse}
+	warm := map[int]int{} // palette index to warm start index
+	b := img.Bounds()
+	var e0, e1 uint64 // total error, cold and warm start
+	cold := median.Quantizer(64).Paletted(img)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			i := int(pi.ColorIndexAt(x, y))
+			w := lp.IndexNear(img.At(x, y))
+			if wi, ok := warm[i]; ok && wi != w {
+				t.Fatalf("palette color %d has pixels of warm colors %d, %d",
+					i, wi, w)
+			}
+			warm[i] = w
+			e0 += testimage.SqDiff(img.At(x, y), cold.At(x, y))
+			e1 += testimage.SqDiff(img.At(x, y), pi.At(x, y))
+		}
+	}
+	if e1 > e0*3/2 {
+		t.Fatalf("error %d with warm start, %d cold", e1, e0)
+	}
+}
+
+func TestHybridChroma(t *testing.T) {
+	// near-neutral pixels with R range slightly wider than G range
+	img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	img.Set(0, 0, color.RGBA{0x70, 0x78, 0x80, 0xff})
+	img.Set(1, 0, color.RGBA{0x90, 0x78, 0x80, 0xff})
+	img.Set(0, 1, color.RGBA{0x70, 0x94, 0x80, 0xff})
+	img.Set(1, 1, color.RGBA{0x90, 0x94, 0x80, 0xff})
+	split := func(cf median.Config) int {
+		return cf.Palette(img).(quant.TreePalette).Root.Type
+	}
+	if s := split(median.Config{N: 2}); s != quant.TSplitR {
+		t.Fatalf("default split %d, want TSplitR", s)
+	}
+	if s := split(median.Config{N: 2, HybridChroma: 20}); s != quant.TSplitG {
+		t.Fatalf("hybrid split %d, want TSplitG", s)
+	}
+	// saturated pixels are split by RGB range
+	img.Set(0, 0, color.RGBA{0xd0, 0x18, 0x20, 0xff})
+	img.Set(1, 0, color.RGBA{0xf0, 0x18, 0x20, 0xff})
+	img.Set(0, 1, color.RGBA{0xd0, 0x34, 0x20, 0xff})
+	img.Set(1, 1, color.RGBA{0xf0, 0x34, 0x20, 0xff})
+	if s := split(median.Config{N: 2, HybridChroma: 20}); s != quant.TSplitR {
+		t.Fatalf("saturated hybrid split %d, want TSplitR", s)
+	}
+}
+
+func TestColorModel(t *testing.T) {
+	img := testimage.Synthetic()
+	want := median.Quantizer(16).Paletted(img)
+	cf := median.Config{N: 16, ColorModel: color.NRGBAModel}
+	pi := cf.Paletted(img)
+	pi2, _ := cf.ImageAndPalette(img)
+	for _, pi := range []*image.Paletted{pi, pi2} {
+		if !bytes.Equal(pi.Pix, want.Pix) {
+			t.Fatal("pixels differ")
+		}
+		for i, c := range pi.Palette {
+			if c != color.NRGBAModel.Convert(want.Palette[i]) {
+				t.Fatalf("color %d = %#v", i, c)
+			}
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	key := color.RGBA{0xff, 0, 0xff, 0xff}
+	syn := testimage.Synthetic()
+	frames := make([]image.Image, 3)
+	for i := range frames {
+		f := image.NewRGBA(image.Rect(0, 0, 16, 16))
+		draw.Draw(f, f.Rect, &image.Uniform{key}, image.Point{}, draw.Src)
+		// sprite in the middle, from a different part of the image
+		r := image.Rect(4, 4, 12, 12)
+		draw.Draw(f, r, syn, image.Pt(i*20, i*20), draw.Src)
+		frames[i] = f
+	}
+	pis, p := median.Quantizer(16).Batch(frames, key)
+	cp := p.ColorPalette()
+	if len(cp) > 16 || cp[0] != key {
+		t.Fatalf("palette %v", cp)
+	}
+	for i, pi := range pis {
+		if &pi.Palette[0] != &pis[0].Palette[0] {
+			t.Fatalf("frame %d palette not shared", i)
+		}
+		for y := 0; y < 16; y++ {
+			for x := 0; x < 16; x++ {
+				sprite := image.Pt(x, y).In(image.Rect(4, 4, 12, 12))
+				if ix := pi.ColorIndexAt(x, y); sprite != (ix != 0) {
+					t.Fatalf("frame %d pixel %d,%d index %d", i, x, y, ix)
+				}
+			}
+		}
+	}
+	// n below 2 still leaves an opaque color for sprite pixels
+	for _, n := range []int{-1, 0, 1} {
+		pis, p := median.Quantizer(n).Batch(frames, key)
+		if p.Len() != 2 {
+			t.Fatalf("n = %d: %d colors", n, p.Len())
+		}
+		if ix := pis[0].ColorIndexAt(8, 8); ix != 1 {
+			t.Fatalf("n = %d: sprite pixel index %d", n, ix)
+		}
+	}
+}
+
+func TestBudget(t *testing.T) {
+	img := testimage.Synthetic()
+	pi, p := median.Config{N: 256, Budget: time.Nanosecond}.ImageAndPalette(img)
+	if len(pi.Palette) >= 256 || p.Len() != len(pi.Palette) {
+		t.Fatalf("%d colors, palette Len %d", len(pi.Palette), p.Len())
+	}
+	if err := p.(quant.TreePalette).Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIndexed(t *testing.T) {
+	img := testimage.Synthetic()
+	if _, ok := median.Quantizer(256).Indexed(img).(*image.Paletted); !ok {
+		t.Fatal("n = 256 not *image.Paletted")
+	}
+	for _, cf := range []median.Config{
+		{N: 1000},
+		{N: 1000, AlphaThreshold: 0x8000},
+		{N: 1000, TwoPass: true},
+	} {
+		ii, ok := cf.Indexed(img).(*quant.IndexedImage)
+		if !ok {
+			t.Fatalf("%+v: not *quant.IndexedImage", cf)
+		}
+		if n := len(ii.Palette); n <= 256 || n > cf.N {
+			t.Fatalf("%+v: %d colors", cf, n)
+		}
+		for _, x := range ii.Pix {
+			if int(x) >= len(ii.Palette) {
+				t.Fatalf("%+v: index %d out of palette", cf, x)
+			}
+		}
+		if e, e256 := quant.MSE(img, ii), quant.MSE(img, median.Quantizer(256).Paletted(img)); e >= e256 {
+			t.Fatalf("%+v: MSE %g, 256 colors %g", cf, e, e256)
+		}
+	}
+}
+
+func TestTiming(t *testing.T) {
+	img := testimage.Synthetic()
+	var tm quant.Timing
+	pi := median.Config{N: 256, Timing: &tm}.Paletted(img)
+	if tm.Scan <= 0 || tm.Cut <= 0 || tm.Split <= 0 {
+		t.Fatalf("%+v", tm)
+	}
+	// timing does not change results
+	if !reflect.DeepEqual(pi, median.Quantizer(256).Paletted(img)) {
+		t.Fatal("result differs with Timing")
+	}
+}
+
+func TestChromaKey(t *testing.T) {
+	// green key with slight noise, around a gradient subject
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			c := color.NRGBA{uint8(x), 0xff - uint8(y%3), uint8(y % 2), 0xff}
+			if x >= 8 && x < 24 && y >= 8 && y < 24 {
+				c = color.NRGBA{uint8(x * 8), uint8(y * 4), 0x80, 0xff}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	cf := median.Config{N: 8, ChromaKey: color.NRGBA{0, 0xff, 0, 0xff},
+		ChromaTolerance: 0x2000}
+	pi := cf.Paletted(img)
+	if len(pi.Palette) != 8 {
+		t.Fatalf("%d colors, want 8", len(pi.Palette))
+	}
+	if _, _, _, a := pi.Palette[0].RGBA(); a != 0 {
+		t.Fatalf("color 0 not transparent")
+	}
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			key := !(x >= 8 && x < 24 && y >= 8 && y < 24)
+			if ix := pi.ColorIndexAt(x, y); key != (ix == 0) {
+				t.Fatalf("pixel %d,%d: index %d", x, y, ix)
+			}
+		}
+	}
+	// no palette colors are spent on the key
+	for _, c := range pi.Palette[1:] {
+		if _, g, _, _ := c.RGBA(); g > 0x8000 {
+			t.Fatalf("key color %v in palette", c)
+		}
+	}
+}
+
+func TestExtend(t *testing.T) {
+	img := testimage.Synthetic()
+	prev := median.Quantizer(8).Palette(img)
+	p := median.Quantizer(0).Extend(prev, img, 16)
+	cp := p.ColorPalette()
+	if len(cp) != 16 {
+		t.Fatalf("%d colors, want 16", len(cp))
+	}
+	if !reflect.DeepEqual(cp[:8], prev.ColorPalette()) {
+		t.Fatal("colors of prev changed")
+	}
+	e0 := quant.MSE(img, quant.Paletted(prev, img))
+	e1 := quant.MSE(img, quant.Paletted(p, img))
+	if e1 >= e0 {
+		t.Fatalf("MSE %g, prev %g", e1, e0)
+	}
+	// no more colors than prev
+	if p := median.Quantizer(0).Extend(prev, img, 4); !reflect.DeepEqual(
+		p.ColorPalette(), prev.ColorPalette()) {
+		t.Fatal("n <= len(prev) changed prev")
+	}
+	// colors of prev not in the image still keep their indexes
+	far := quant.LinearPalette{Palette: color.Palette{
+		color.RGBA{1, 2, 3, 0xff}, color.RGBA{0xff, 0, 0xfe, 0xff}}}
+	p = median.Quantizer(0).Extend(far, img, 10)
+	if cp := p.ColorPalette(); len(cp) != 10 || cp[0] != far.Palette[0] ||
+		cp[1] != far.Palette[1] {
+		t.Fatalf("got %v", cp)
+	}
+}
+
+func TestGreatestVariance(t *testing.T) {
+	// a red ramp, with one stray pixel far out in blue
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 1))
+	for x := 0; x < 64; x++ {
+		img.SetNRGBA(x, 0, color.NRGBA{uint8(x * 2), 0, 0, 0xff})
+	}
+	img.SetNRGBA(63, 0, color.NRGBA{0x7e, 0, 0xff, 0xff})
+	g := median.Config{N: 2}.Gamuts(img)
+	// by range, blue is split, separating the stray pixel
+	if g[0].Min.B != 0xffff && g[1].Min.B != 0xffff {
+		t.Fatalf("WidestRange split not in blue: %v", g)
+	}
+	g = median.Config{N: 2, Channel: median.GreatestVariance}.Gamuts(img)
+	// by variance, red is split into two halves of the ramp
+	for _, gm := range g {
+		if gm.Max.R-gm.Min.R > 0x4000 {
+			t.Fatalf("GreatestVariance split not in red: %v", g)
+		}
+	}
+}
+
+func TestExactDominant(t *testing.T) {
+	// background of one color, with noise in the same cluster
+	bg := color.NRGBA{0x31, 0x62, 0x93, 0xff}
+	img := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for i := 0; i < len(img.Pix); i += 4 {
+		c := bg
+		switch i / 4 % 5 {
+		case 1:
+			c.R += 9
+		case 2:
+			c.B -= 7
+		case 3:
+			c = color.NRGBA{0xff, 0xff, 0, 0xff}
+		}
+		copy(img.Pix[i:], []uint8{c.R, c.G, c.B, c.A})
+	}
+	has := func(cp color.Palette) bool {
+		for _, c := range cp {
+			if color.NRGBAModel.Convert(c) == bg {
+				return true
+			}
+		}
+		return false
+	}
+	if has(median.Quantizer(2).Paletted(img).Palette) {
+		t.Fatal("background exact without ExactDominant")
+	}
+	if pi := (median.Config{N: 2, ExactDominant: true}).Paletted(img); !has(pi.Palette) {
+		t.Fatalf("background %v not in palette %v", bg, pi.Palette)
+	}
+}
+
+func TestSelectiveDither(t *testing.T) {
+	// flat fill on the left, gradient on the right
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 64; x++ {
+			c := color.NRGBA{0x20, 0x90, 0x40, 0xff}
+			if x >= 32 {
+				c = color.NRGBA{uint8(x * 4), uint8(y * 8), 0x80, 0xff}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	q := median.Quantizer(8)
+	pi := q.SelectiveDither(img, quant.Sierra24A{}, 0x800)
+	// flat area is one index
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 30; x++ {
+			if pi.ColorIndexAt(x, y) != pi.ColorIndexAt(0, 0) {
+				t.Fatalf("flat area not flat at %d,%d", x, y)
+			}
+		}
+	}
+	// gradient is dithered, differing from the undithered image
+	plain := q.Paletted(img)
+	diff := 0
+	for y := 0; y < 32; y++ {
+		for x := 32; x < 64; x++ {
+			if pi.At(x, y) != plain.At(x, y) {
+				diff++
+			}
+		}
+	}
+	if diff == 0 {
+		t.Fatal("gradient not dithered")
+	}
+	// flat 0 dithers everything but the exactly flat area
+	if pi := q.SelectiveDither(img, quant.Sierra24A{}, 0); pi.ColorIndexAt(0, 0) !=
+		pi.ColorIndexAt(29, 31) {
+		t.Fatal("flat 0")
+	}
+}
+
+func TestQuantizeInPlaceType(t *testing.T) {
+	src := testimage.Synthetic()
+	q := median.Quantizer(16)
+	want := q.RGBAImage(src)
+	rgba := image.NewRGBA(src.Rect.Add(image.Pt(3, 5)))
+	draw.Draw(rgba, rgba.Rect, src, src.Rect.Min, draw.Src)
+	for _, img := range []image.Image{src, rgba} {
+		got := q.QuantizeInPlaceType(img)
+		if reflect.TypeOf(got) != reflect.TypeOf(img) || got.Bounds() != img.Bounds() {
+			t.Fatalf("got %T %v, want %T %v",
+				got, got.Bounds(), img, img.Bounds())
+		}
+		d := img.Bounds().Min.Sub(src.Rect.Min)
+		for y := src.Rect.Min.Y; y < src.Rect.Max.Y; y++ {
+			for x := src.Rect.Min.X; x < src.Rect.Max.X; x++ {
+				if testimage.SqDiff(got.At(x+d.X, y+d.Y), want.At(x, y)) != 0 {
+					t.Fatalf("%T: pixel %d,%d = %v, want %v", img, x, y,
+						got.At(x+d.X, y+d.Y), want.At(x, y))
+				}
+			}
+		}
+	}
+	if _, ok := q.QuantizeInPlaceType(q.Paletted(src)).(*image.Paletted); !ok {
+		t.Fatal("Paletted type not preserved")
+	}
+	yc := image.NewYCbCr(src.Rect, image.YCbCrSubsampleRatio420)
+	if _, ok := q.QuantizeInPlaceType(yc).(*image.NRGBA); !ok {
+		t.Fatal("YCbCr result not NRGBA")
+	}
+}
+
+func TestSample(t *testing.T) {
+	img := testimage.Synthetic()
+	for _, s := range []median.Sampling{median.Strided, median.Shuffled} {
+		cf := median.Config{N: 16, Sample: 500, Sampling: s, Seed: 7}
+		pi, p := cf.ImageAndPalette(img)
+		// every pixel is mapped to the nearest palette color
+		for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+			for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+				if pi.At(x, y) != p.ColorNear(img.At(x, y)) {
+					t.Fatalf("sampling %d: pixel %d,%d not mapped", s, x, y)
+				}
+			}
+		}
+		if !reflect.DeepEqual(cf.Paletted(img), pi) {
+			t.Fatalf("sampling %d not reproducible", s)
+		}
+	}
+	// vertical stripes of two colors.  a stride of 2 sees only one.
+	stripes := image.NewNRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			c := color.NRGBA{0xff, 0, 0, 0xff}
+			if x%2 == 1 {
+				c = color.NRGBA{0, 0, 0xff, 0xff}
+			}
+			stripes.SetNRGBA(x, y, c)
+		}
+	}
+	cf := median.Config{N: 2, Sample: 64 * 32}
+	if n := len(cf.Paletted(stripes).Palette); n != 1 {
+		t.Fatalf("strided: %d colors, want 1", n)
+	}
+	cf.Sampling = median.Shuffled
+	if n := len(cf.Paletted(stripes).Palette); n != 2 {
+		t.Fatalf("shuffled: %d colors, want 2", n)
+	}
+}
+
+// countingImage counts calls to At by pixel.
+type countingImage struct {
+	image.Image
+	n map[image.Point]int
+}
+
+func (c *countingImage) At(x, y int) color.Color {
+	c.n[image.Pt(x, y)]++
+	return c.Image.At(x, y)
+}
+
+func TestAtOnce(t *testing.T) {
+	src := testimage.Synthetic()
+	q := median.Quantizer(16)
+	for _, f := range []func(image.Image){
+		func(img image.Image) { q.Paletted(img) },
+		func(img image.Image) { q.Palette(img) },
+	} {
+		img := &countingImage{src, map[image.Point]int{}}
+		f(img)
+		for y := src.Rect.Min.Y; y < src.Rect.Max.Y; y++ {
+			for x := src.Rect.Min.X; x < src.Rect.Max.X; x++ {
+				if n := img.n[image.Pt(x, y)]; n != 1 {
+					t.Fatalf("At(%d, %d) called %d times", x, y, n)
+				}
+			}
+		}
+	}
+	// results are as with the image read directly
+	if !reflect.DeepEqual(q.Paletted(&countingImage{src, map[image.Point]int{}}),
+		q.Paletted(src)) {
+		t.Fatal("results differ")
+	}
+}
+
+func TestBackground(t *testing.T) {
+	// left half transparent, right half half-transparent red
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for y := 0; y < 16; y++ {
+		for x := 8; x < 16; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{0xff, 0, 0, 0x80})
+		}
+	}
+	near := func(c color.Color, r, g, b uint8) bool {
+		return testimage.SqDiff(c, color.RGBA{r, g, b, 0xff}) < 0x200*0x200
+	}
+	cf := median.Config{N: 4, Background: color.White}
+	pi := cf.Paletted(img)
+	if !near(pi.At(0, 0), 0xff, 0xff, 0xff) {
+		t.Fatalf("transparent pixel %v, want white", pi.At(0, 0))
+	}
+	if !near(pi.At(15, 15), 0xff, 0x7f, 0x7f) {
+		t.Fatalf("red pixel %v, want pink", pi.At(15, 15))
+	}
+	cf.AlphaThreshold = 0x100
+	pi = cf.Paletted(img)
+	if pi.ColorIndexAt(0, 0) != 0 || !near(pi.At(15, 15), 0xff, 0x7f, 0x7f) {
+		t.Fatalf("with AlphaThreshold: %v, %v", pi.At(0, 0), pi.At(15, 15))
+	}
+}
+
+func TestTreePalette(t *testing.T) {
+	img := testimage.Synthetic()
+	q := median.Quantizer(16)
+	tp := q.TreePalette(img)
+	if err := tp.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if tp.Len() != 16 {
+		t.Fatalf("%d colors, want 16", tp.Len())
+	}
+	pi := q.Paletted(img)
+	if !reflect.DeepEqual(tp.ColorPalette(), pi.Palette) {
+		t.Fatal("colors differ from Paletted")
+	}
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			if i := tp.IndexNear(img.At(x, y)); i != int(pi.ColorIndexAt(x, y)) {
+				t.Fatalf("pixel %d,%d: index %d, Paletted %d",
+					x, y, i, pi.ColorIndexAt(x, y))
+			}
+		}
+	}
+}
+
+func TestImageWithClusters(t *testing.T) {
+	img := testimage.Synthetic()
+	sub := img.SubImage(image.Rect(5, 7, 50, 40))
+	pi, pts := median.Quantizer(16).ImageWithClusters(sub)
+	if len(pts) != len(pi.Palette) {
+		t.Fatalf("%d clusters, %d colors", len(pts), len(pi.Palette))
+	}
+	n := 0
+	for i, c := range pts {
+		if len(c) == 0 {
+			t.Fatalf("cluster %d empty", i)
+		}
+		for _, p := range c {
+			if !p.In(sub.Bounds()) || pi.ColorIndexAt(p.X, p.Y) != uint8(i) {
+				t.Fatalf("cluster %d: point %v", i, p)
+			}
+		}
+		n += len(c)
+	}
+	if b := sub.Bounds(); n != b.Dx()*b.Dy() {
+		t.Fatalf("%d points, want %d", n, b.Dx()*b.Dy())
+	}
+}
+
+func TestQuantizeWeighted(t *testing.T) {
+	// red and blue ramps
+	ramp := func(f func(v uint8) color.Color) image.Image {
+		img := image.NewRGBA(image.Rect(0, 0, 64, 16))
+		for y := 0; y < 16; y++ {
+			for x := 0; x < 64; x++ {
+				img.Set(x, y, f(uint8(x*4)))
+			}
+		}
+		return img
+	}
+	red := ramp(func(v uint8) color.Color { return color.RGBA{v, 0, 0, 255} })
+	blue := ramp(func(v uint8) color.Color { return color.RGBA{0, 0, v, 255} })
+	imgs := []image.Image{red, blue}
+	mse := func(img image.Image, p quant.Palette) float64 {
+		return quant.MSE(img, quant.Paletted(p, img))
+	}
+	even := median.QuantizeWeighted(imgs, nil, 8)
+	heavy := median.QuantizeWeighted(imgs, []float64{4, 1}, 8)
+	if mse(red, heavy) >= mse(red, even) || mse(blue, heavy) <= mse(blue, even) {
+		t.Fatalf("red MSE %g weighted, %g even; blue %g weighted, %g even",
+			mse(red, heavy), mse(red, even), mse(blue, heavy), mse(blue, even))
+	}
+	// only relative weights matter
+	if p := median.QuantizeWeighted(imgs, []float64{8, 2}, 8); !reflect.DeepEqual(
+		p.ColorPalette(), heavy.ColorPalette()) {
+		t.Fatal("scaled weights changed palette")
+	}
+	// zero weight ignores an image
+	if p := median.QuantizeWeighted(imgs, []float64{1, 0}, 8); !reflect.DeepEqual(
+		p.ColorPalette(), median.QuantizeWeighted(imgs[:1], nil, 8).ColorPalette()) {
+		t.Fatal("zero weight image not ignored")
+	}
+}
+
+func TestCanonical(t *testing.T) {
+	img := testimage.Synthetic()
+	cf := median.Config{N: 16, Canonical: true}
+	pi := cf.Paletted(img)
+	want, _ := quant.OrderCanonical(median.Quantizer(16).Palette(img))
+	if !reflect.DeepEqual(pi.Palette, want.Palette) {
+		t.Fatal("Paletted palette not canonical")
+	}
+	// pixels keep their colors
+	orig := median.Quantizer(16).Paletted(img)
+	for i := range pi.Pix {
+		if pi.Palette[pi.Pix[i]] != orig.Palette[orig.Pix[i]] {
+			t.Fatalf("pixel %d changed color", i)
+		}
+	}
+	if p := cf.Palette(img); !reflect.DeepEqual(p.ColorPalette(), want.Palette) {
+		t.Fatal("Palette not canonical")
+	}
+	pi2, p := cf.ImageAndPalette(img)
+	if !reflect.DeepEqual(pi2, pi) || !reflect.DeepEqual(p.ColorPalette(), want.Palette) {
+		t.Fatal("ImageAndPalette not canonical")
+	}
+}
+
+func TestLocality(t *testing.T) {
+	img := testimage.Synthetic()
+	for _, n := range []int{16, 256} {
+		want := median.Config{N: n}.Paletted(img)
+		if got := (median.Config{N: n, Locality: true}).Paletted(img); !reflect.DeepEqual(got, want) {
+			t.Fatalf("n = %d: result differs with Locality", n)
+		}
+	}
+}
+
+func TestLuminanceBounds(t *testing.T) {
+	img := testimage.Synthetic()
+	const lo, hi = 0x3000, 0xc000
+	cf := median.Config{N: 16, MinLuminance: lo, MaxLuminance: hi}
+	pi := cf.Paletted(img)
+	want := median.Quantizer(16).Paletted(img)
+	if !reflect.DeepEqual(pi.Pix, want.Pix) {
+		t.Fatal("pixel mapping changed")
+	}
+	moved := 0
+	for i, c := range pi.Palette {
+		y := color.Gray16Model.Convert(c).(color.Gray16).Y
+		if y < lo-1 || y > hi+1 {
+			t.Fatalf("color %d %v luminance %#x", i, c, y)
+		}
+		if c != want.Palette[i] {
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Fatal("no colors moved")
+	}
+	// pure blue cannot reach the bound by blue alone
+	blue := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	draw.Draw(blue, blue.Rect, image.NewUniform(color.RGBA{0, 0, 0xff, 0xff}),
+		image.Point{}, draw.Src)
+	c := median.Config{N: 1, MinLuminance: 0x8000}.Palette(blue).ColorPalette()[0]
+	r, g, b, _ := c.RGBA()
+	if b != 0xffff || r == 0 || g == 0 {
+		t.Fatalf("blue moved to %v", c)
+	}
+}
+
+func TestPopulationVolume(t *testing.T) {
+	// a large nearly flat gray area and a small area of varied reds
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			v := uint8(0x78 + (x*7+y*3)%17)
+			c := color.RGBA{v, v, v, 0xff}
+			if y >= 56 {
+				c = color.RGBA{uint8(0xc0 + x), uint8(x * 7 % 64), uint8((y - 56) * 8), 0xff}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	// squared error of pixels in rows y0 to y1
+	sq := func(pi *image.Paletted, y0, y1 int) (e uint64) {
+		for y := y0; y < y1; y++ {
+			for x := 0; x < 64; x++ {
+				e += testimage.SqDiff(img.At(x, y), pi.At(x, y))
+			}
+		}
+		return
+	}
+	// start from one cluster for each area, leaving one split to be made
+	ws := color.Palette{color.RGBA{0x80, 0x80, 0x80, 0xff}, color.RGBA{0xe0, 0x20, 0x20, 0xff}}
+	pop := median.Config{N: 3, WarmStart: ws}.Paletted(img)
+	vol := median.Config{N: 3, WarmStart: ws, Priority: median.PopulationVolume}.Paletted(img)
+	// the split goes to the small colorful area rather than the large
+	// flat one
+	if sq(vol, 56, 64) >= sq(pop, 56, 64) || sq(vol, 0, 56) <= sq(pop, 0, 56) {
+		t.Fatalf("colorful error %d with PopulationVolume, %d with Population; "+
+			"flat %d, %d", sq(vol, 56, 64), sq(pop, 56, 64), sq(vol, 0, 56), sq(pop, 0, 56))
+	}
+}
+
+func TestLinear(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetRGBA(x, y, color.RGBA{uint8(x * 4), uint8(y * 4), uint8((x + y) * 2), 0xff})
+		}
+	}
+	// dark returns the number of palette colors with mean channel value
+	// in the lowest quarter
+	dark := func(p quant.Palette) int {
+		n := 0
+		for _, c := range p.ColorPalette() {
+			r, g, b, _ := c.RGBA()
+			if (r+g+b)/3 < 0x4000 {
+				n++
+			}
+		}
+		return n
+	}
+	cf := median.Config{N: 16, Priority: median.PopulationVolume}
+	d0 := dark(cf.Palette(img))
+	cf.Linear = true
+	pl := cf.Palette(img)
+	// linear light compresses shadow ranges, so shadows get fewer colors
+	if d1 := dark(pl); d1 >= d0 {
+		t.Fatalf("%d dark colors with Linear, %d without", d1, d0)
+	}
+	// palette colors are still averages of gamma encoded values: each is
+	// the mean of the pixels mapped to it
+	pi := cf.Paletted(img)
+	for i, c := range pi.Palette {
+		var rs, n uint32
+		for y := 0; y < 64; y++ {
+			for x := 0; x < 64; x++ {
+				if pi.ColorIndexAt(x, y) == uint8(i) {
+					r, _, _, _ := img.At(x, y).RGBA()
+					rs += r
+					n++
+				}
+			}
+		}
+		if r, _, _, _ := c.RGBA(); n > 0 && r != rs/n {
+			t.Fatalf("color %d red %#x, mean %#x", i, r, rs/n)
+		}
+	}
+}
+
+func TestTinyImages(t *testing.T) {
+	testimage.TinyImages(t, func(n int) testimage.Quantizer { return median.Quantizer(n) })
+}
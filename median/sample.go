@@ -0,0 +1,87 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package median
+
+import (
+	"image/color"
+	"math/rand"
+	"sort"
+)
+
+// Sampling values select how pixels are sampled for Config.Sample.
+type Sampling int
+
+const (
+	// Strided samples pixels at a fixed interval in row-major order.  It
+	// is fast and needs no seed, and works well with photographs.  With
+	// images of periodic patterns though, such as tiles, stripes, or
+	// ordered dithering, the interval can alias with the pattern so that
+	// the sample over-represents some colors and misses others.
+	Strided Sampling = iota
+	// Shuffled samples pixels by a pseudo-random permutation seeded by
+	// Config.Seed.  The sample is spatially uniform without aliasing with
+	// periodic patterns and is reproducible for a given seed.  It is a
+	// little slower than Strided.
+	Shuffled
+)
+
+// sample replaces the points of the initial cluster with a sample of them
+// by Config.Sample and Config.Sampling.  It returns all points, or nil if
+// no sample is taken.
+func (qz *quantizer) sample() []point {
+	n := qz.cf.Sample
+	if len(qz.cs) == 0 || n <= 0 || n >= len(qz.cs[0].px) {
+		return nil
+	}
+	all := qz.cs[0].px
+	px := make([]point, n)
+	if qz.cf.Sampling == Shuffled {
+		// partial Fisher-Yates shuffle of a copy of all points
+		perm := append([]point{}, all...)
+		r := rand.New(rand.NewSource(qz.cf.Seed))
+		for i := range px {
+			j := i + r.Intn(len(perm)-i)
+			perm[i], perm[j] = perm[j], perm[i]
+		}
+		copy(px, perm)
+		// restore row-major order for locality of pixel access
+		sort.Slice(px, func(i, j int) bool { return px[i] < px[j] })
+	} else {
+		for i := range px {
+			px[i] = all[i*len(all)/n]
+		}
+	}
+	qz.initCluster(px)
+	return all
+}
+
+// assign assigns points px to clusters by nearest palette color, after
+// clustering a sample of them.
+func (qz *quantizer) assign(px []point) {
+	p := qz.palette()
+	// cluster by palette index
+	byIndex := make([]*cluster, len(qz.cs))
+	for i := range qz.cs {
+		byIndex[qz.cs[i].node.Index] = &qz.cs[i]
+	}
+	// counting sort of points by palette index
+	ix := make([]int, len(px))
+	n := make([]int, len(qz.cs))
+	for i, pt := range px {
+		r, g, b, a := qz.pxRGBA(int(pt))
+		x := p.IndexNear(color.RGBA64{uint16(r), uint16(g), uint16(b), uint16(a)})
+		ix[i] = x
+		n[x]++
+	}
+	sorted := make([]point, len(px))
+	start := 0
+	for x, c := range byIndex {
+		c.px = sorted[start : start : start+n[x]]
+		start += n[x]
+	}
+	for i, pt := range px {
+		c := byIndex[ix[i]]
+		c.px = append(c.px, pt)
+	}
+}
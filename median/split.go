@@ -0,0 +1,93 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package median
+
+import "github.com/soniakeys/quant"
+
+// SplitStrategy chooses the cluster to split at each step of clustering
+// and the value at which to split it.
+//
+// Clustering otherwise proceeds as with median cut, splitting clusters in
+// the RGB channel with the widest range until Config.N clusters are
+// populated or no cluster has color variation.
+type SplitStrategy interface {
+	// SelectCluster returns the index in cs of the cluster to split.
+	// All clusters in cs have color variation and can be split.
+	SelectCluster(cs []*Cluster) int
+	// CutValue returns the value in channel c.Channel at which to split c.
+	// Points with lesser values go to one new cluster, points with values
+	// greater or equal go to the other.  Values outside of c.Range are
+	// adjusted so that neither new cluster is empty.
+	CutValue(c *Cluster) uint32
+}
+
+// Cluster describes a cluster of pixels to a SplitStrategy.
+type Cluster struct {
+	Population int         // number of pixels represented
+	Gamut      quant.Gamut // extents of colors
+	Channel    int         // channel to split, 0, 1, or 2 for R, G, or B
+	Priority   float64     // priority by Config.Priority
+
+	c  *cluster
+	qz *quantizer
+}
+
+// view returns a Cluster describing c.  Statistics of c must be current.
+func (qz *quantizer) view(c *cluster) *Cluster {
+	return &Cluster{
+		Population: c.pop,
+		Gamut:      c.gamut,
+		Channel:    c.widestCh,
+		Priority:   c.priority,
+		c:          c,
+		qz:         qz,
+	}
+}
+
+// Range returns the least and greatest values of cluster points in
+// channel c.Channel.
+func (c *Cluster) Range() (lo, hi uint32) {
+	min, max := c.Gamut.Min, c.Gamut.Max
+	switch c.Channel {
+	case rgbR:
+		return uint32(min.R), uint32(max.R)
+	case rgbG:
+		return uint32(min.G), uint32(max.G)
+	}
+	return uint32(min.B), uint32(max.B)
+}
+
+// Values calls f for each point of the cluster with the point value in
+// channel c.Channel and the number of pixels the point represents.
+func (c *Cluster) Values(f func(v uint32, n int)) {
+	for _, p := range c.c.px {
+		f(c.qz.chValue(p, c.Channel), c.qz.weight(p))
+	}
+}
+
+// MedianCut is the SplitStrategy of the default median cut algorithm.  It
+// selects the cluster of highest priority and cuts it at the median value.
+//
+// Config implements MedianCut with a priority queue rather than by calling
+// these methods.  Strategies that embed MedianCut to override one method
+// are run with the methods, and the cluster selected among clusters of
+// equal priority may then differ from that of MedianCut.
+type MedianCut struct{}
+
+// SelectCluster selects the first cluster of highest priority.
+func (MedianCut) SelectCluster(cs []*Cluster) int {
+	x := 0
+	for i, c := range cs {
+		if c.Priority > cs[x].Priority {
+			x = i
+		}
+	}
+	return x
+}
+
+// CutValue returns the median value, adjusted to make a more equitable
+// cut when values equal to the median are numerous.
+func (MedianCut) CutValue(c *Cluster) uint32 {
+	return c.qz.medianCut(c.c)
+}
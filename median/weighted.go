@@ -0,0 +1,64 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package median
+
+import (
+	"image"
+	"math"
+
+	"github.com/soniakeys/quant"
+)
+
+// weightScale is the count given each pixel of the image of greatest
+// weight by QuantizeWeighted.  Counts of other pixels are in proportion.
+const weightScale = 1 << 10
+
+// QuantizeWeighted derives one palette of no more than n colors for all of
+// imgs, weighting pixels of each image by the corresponding weight.  See
+// Config.QuantizeWeighted.
+func QuantizeWeighted(imgs []image.Image, weights []float64, n int) quant.Palette {
+	return Config{N: n}.QuantizeWeighted(imgs, weights)
+}
+
+// QuantizeWeighted derives one palette of cf.N colors for all of imgs,
+// weighting pixels of each image by the corresponding weight.
+//
+// For a set of images where some matter more than others, such as a hero
+// image with thumbnails, a shared palette can favor the important images.
+// Each pixel of imgs[i] counts weights[i] times in a histogram of all
+// images, so it adds that much to the population of the clusters it falls
+// in.  Split priority and median cuts follow population so images of
+// greater weight get proportionally more palette fidelity.  Only relative
+// weights matter.  Images with weights <= 0 are ignored.  Images beyond
+// the length of weights have weight 1.
+//
+// The histogram is of exact colors, as with Batch.  Options of cf are
+// used as with QuantizeHistogram.
+func (cf Config) QuantizeWeighted(imgs []image.Image, weights []float64) quant.Palette {
+	w := func(i int) float64 {
+		if i < len(weights) {
+			return weights[i]
+		}
+		return 1
+	}
+	max := 0.
+	for i := range imgs {
+		if w(i) > max {
+			max = w(i)
+		}
+	}
+	var t tally
+	for i, img := range imgs {
+		if w(i) <= 0 {
+			continue
+		}
+		// at least 1 so that low weight images still contribute colors
+		c := int(math.Round(w(i) / max * weightScale))
+		if c < 1 {
+			c = 1
+		}
+		t.addWeighted(cf.composite(img), nil, c)
+	}
+	return cf.QuantizeHistogram(t.colors, t.counts)
+}
@@ -0,0 +1,76 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package quant
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// NoiseShaped satisfies draw.Drawer, adding noise to break up banding.
+//
+// Rather than diffusing error as Sierra24A does, it adds a small amount of
+// noise with a triangular probability distribution (TPDF) to each pixel
+// before finding the nearest palette color.  It is cheaper than error
+// diffusion and is often enough for subtle gradients.
+//
+// Noise for each pixel depends only on Seed and the pixel coordinates, so
+// results are reproducible for a given Seed and pixels could be processed
+// in any order.
+type NoiseShaped struct {
+	// Amplitude is the maximum noise added to or subtracted from each
+	// color channel, in the 16 bit units of color.Color.RGBA.
+	Amplitude int32
+	Seed      uint64
+}
+
+var _ draw.Drawer = NoiseShaped{}
+
+// Draw maps src to the palette of dst after adding noise.
+//
+// This method satisfies the draw.Drawer interface.  As with Sierra24A,
+// dst must be an *image.Paletted for noise to be added.
+func (d NoiseShaped) Draw(dst draw.Image, r image.Rectangle, src image.Image, sp image.Point) {
+	drawPaletted(dst, r, src, sp, d.noise)
+}
+
+func (d NoiseShaped) noise(i0 image.Image, cp color.Palette) *image.Paletted {
+	if len(cp) > 256 {
+		return nil
+	}
+	b := i0.Bounds()
+	pi := image.NewPaletted(b, cp)
+	sp := newSPalette(cp)
+	var c sRGB
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r0, g0, b0, _ := i0.At(x, y).RGBA()
+			c.r = int32(r0) + d.tpdf(x, y, 0)
+			c.g = int32(g0) + d.tpdf(x, y, 1)
+			c.b = int32(b0) + d.tpdf(x, y, 2)
+			c.clamp()
+			pi.SetColorIndex(x, y, uint8(sp.index(c)))
+		}
+	}
+	return pi
+}
+
+// tpdf returns triangular distributed noise in the range
+// -d.Amplitude to d.Amplitude for channel ch of pixel x, y.
+func (d NoiseShaped) tpdf(x, y, ch int) int32 {
+	h := hash(d.Seed, uint64(uint32(x))<<32|uint64(uint32(y)), uint64(ch))
+	// sum of two uniform values is triangular
+	u := int64(h&0xffff) + int64(h>>16&0xffff) - 0xffff
+	return int32(u * int64(d.Amplitude) / 0xffff)
+}
+
+// hash mixes its arguments into a pseudo random value.
+// It uses the finalizer of the SplitMix64 generator.
+func hash(a, b, c uint64) uint64 {
+	z := a + b*0x9e3779b97f4a7c15 + c*0xbf58476d1ce4e5b9
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	return z ^ z>>31
+}
@@ -0,0 +1,134 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package quant
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"sort"
+)
+
+// OrderByProximity reorders a palette so that colors at adjacent indices
+// are similar.
+//
+// The order is a greedy nearest neighbor tour through color space starting
+// with the darkest color.  Returned is the reordered palette and a remap
+// table where remap[i] is the new index of color i of p.  Use Reindex to fix
+// up an image.Paletted using p.
+func OrderByProximity(p Palette) (LinearPalette, []int) {
+	cp := p.ColorPalette()
+	sp := newSPalette(cp)
+	remap := make([]int, len(cp))
+	out := make(color.Palette, 0, len(cp))
+	if len(cp) == 0 {
+		return LinearPalette{Palette: out}, remap
+	}
+	used := make([]bool, len(cp))
+	// start with darkest
+	cur := 0
+	for i, c := range sp {
+		if luminance(uint32(c.r), uint32(c.g), uint32(c.b)) <
+			luminance(uint32(sp[cur].r), uint32(sp[cur].g), uint32(sp[cur].b)) {
+			cur = i
+		}
+	}
+	for {
+		used[cur] = true
+		remap[cur] = len(out)
+		out = append(out, cp[cur])
+		if len(out) == len(cp) {
+			break
+		}
+		// find nearest unused color
+		next, min := -1, int64(math.MaxInt64)
+		for i, c := range sp {
+			if !used[i] {
+				if d := sp[cur].dist(c); d < min {
+					next, min = i, d
+				}
+			}
+		}
+		cur = next
+	}
+	return LinearPalette{Palette: out}, remap
+}
+
+// OrderByPopulation reorders the palette of pi by descending pixel count,
+// most used colors first.
+//
+// Some viewers show progressive or interlaced GIFs better with important
+// colors first.  Colors of equal count keep their relative order.  Returned
+// is the reordered palette and a remap table as with OrderByProximity.
+// Use Reindex to fix up pi.
+func OrderByPopulation(pi *image.Paletted) (LinearPalette, []int) {
+	u := Usage(pi)
+	order := make([]int, len(u)) // old indexes in new order
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return u[order[i]] > u[order[j]]
+	})
+	remap := make([]int, len(u))
+	out := make(color.Palette, len(u))
+	for n, i := range order {
+		remap[i] = n
+		out[n] = pi.Palette[i]
+	}
+	return LinearPalette{Palette: out}, remap
+}
+
+// OrderCanonical reorders a palette into a canonical order, ascending by
+// red, then green, blue, and alpha, as returned by the RGBA method.
+//
+// Identical sets of colors always give the same order regardless of the
+// order derived by quantization, so results can be compared or cached.
+// Returned is the reordered palette and a remap table as with
+// OrderByProximity.  Use Reindex to fix up an image.Paletted using p.
+func OrderCanonical(p Palette) (LinearPalette, []int) {
+	cp := p.ColorPalette()
+	key := make([][4]uint32, len(cp))
+	order := make([]int, len(cp)) // old indexes in new order
+	for i, c := range cp {
+		r, g, b, a := c.RGBA()
+		key[i] = [4]uint32{r, g, b, a}
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		ki, kj := key[order[i]], key[order[j]]
+		for ch := range ki {
+			if ki[ch] != kj[ch] {
+				return ki[ch] < kj[ch]
+			}
+		}
+		return false
+	})
+	remap := make([]int, len(cp))
+	out := make(color.Palette, len(cp))
+	for n, i := range order {
+		remap[i] = n
+		out[n] = cp[i]
+	}
+	return LinearPalette{Palette: out}, remap
+}
+
+// Reindex updates paletted image pi for a reordered palette p.
+//
+// Argument remap gives the new index for each old index, as returned for
+// example by OrderByProximity.  Pixel indices of pi are replaced through
+// remap and the palette of pi is replaced with the colors of p.  Pixel
+// indices not covered by remap are left unchanged.
+func Reindex(pi *image.Paletted, p Palette, remap []int) {
+	b := pi.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := pi.Pix[pi.PixOffset(b.Min.X, y):][:b.Dx()]
+		for x, i := range row {
+			if int(i) < len(remap) {
+				row[x] = uint8(remap[i])
+			}
+		}
+	}
+	pi.Palette = p.ColorPalette()
+}
@@ -0,0 +1,116 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package quant
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	"github.com/soniakeys/quant/internal"
+)
+
+// Ordered satisfies draw.Drawer, implementing ordered dithering with a
+// Bayer threshold matrix.
+//
+// Unlike error diffusion, each pixel is mapped independently: a threshold
+// offset from the matrix, scaled by Spread, is added to the pixel color
+// before finding the nearest palette color.
+type Ordered struct {
+	// Size is the width and height of the threshold matrix.  It is
+	// rounded up to a power of 2.  Values < 1 mean the default of 4.
+	Size int
+	// Spread is the amplitude of threshold offsets in the 16 bit units of
+	// color.Color.RGBA.  Zero means a default computed from the palette
+	// size, an estimate of the distance between palette colors.
+	Spread int32
+	// Linear, if true, scales threshold offsets in linear light rather than
+	// in the gamma encoded space of color values.  Perceived dither
+	// amplitude is then more uniform across tones, where offsets in gamma
+	// space look too strong in shadows and too weak in highlights.
+	Linear bool
+}
+
+var _ draw.Drawer = Ordered{}
+
+// Draw performs ordered dithering.
+//
+// This method satisfies the draw.Drawer interface.  As with Sierra24A,
+// dst must be an *image.Paletted for dithering to be done.
+func (d Ordered) Draw(dst draw.Image, r image.Rectangle, src image.Image, sp image.Point) {
+	drawPaletted(dst, r, src, sp, d.dither)
+}
+
+func (d Ordered) dither(i0 image.Image, cp color.Palette) *image.Paletted {
+	if len(cp) > 256 {
+		return nil
+	}
+	b := i0.Bounds()
+	pi := image.NewPaletted(b, cp)
+	if b.Empty() || len(cp) == 0 {
+		return pi
+	}
+	n := d.size()
+	m := bayer(n)
+	spread := float64(d.Spread)
+	if spread == 0 {
+		spread = 0xffff / math.Cbrt(float64(len(cp)))
+	}
+	sp := newSPalette(cp)
+	var c sRGB
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := m[(y-b.Min.Y)%n]
+		for x := b.Min.X; x < b.Max.X; x++ {
+			// threshold offset in the range -.5 to .5
+			o := (float64(row[(x-b.Min.X)%n])+.5)/float64(n*n) - .5
+			r0, g0, b0, _ := i0.At(x, y).RGBA()
+			if d.Linear {
+				o *= spread / 0xffff
+				c.r = int32(internal.FromLinear(internal.ToLinear(r0) + o))
+				c.g = int32(internal.FromLinear(internal.ToLinear(g0) + o))
+				c.b = int32(internal.FromLinear(internal.ToLinear(b0) + o))
+			} else {
+				o32 := int32(o * spread)
+				c.r = int32(r0) + o32
+				c.g = int32(g0) + o32
+				c.b = int32(b0) + o32
+				c.clamp()
+			}
+			pi.SetColorIndex(x, y, uint8(sp.index(c)))
+		}
+	}
+	return pi
+}
+
+// size returns d.Size rounded up to a power of 2, or the default of 4.
+func (d Ordered) size() int {
+	if d.Size < 1 {
+		return 4
+	}
+	n := 1
+	for n < d.Size {
+		n *= 2
+	}
+	return n
+}
+
+// bayer returns the n by n Bayer threshold matrix, with values 0 to n*n-1.
+// N must be a power of 2.
+func bayer(n int) [][]int {
+	m := [][]int{{0}}
+	for s := 1; s < n; s *= 2 {
+		// each step quadruples the matrix from the previous one.
+		m2 := make([][]int, 2*s)
+		for y := range m2 {
+			m2[y] = make([]int, 2*s)
+			for x := range m2[y] {
+				q := [2][2]int{{0, 2}, {3, 1}}[y/s][x/s]
+				m2[y][x] = 4*m[y%s][x%s] + q
+			}
+		}
+		m = m2
+	}
+	return m
+}
@@ -0,0 +1,120 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package quant
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+func TestBayer(t *testing.T) {
+	if m := bayer(2); !reflect.DeepEqual(m, [][]int{{0, 2}, {3, 1}}) {
+		t.Fatalf("bayer(2) = %v", m)
+	}
+	for _, n := range []int{1, 2, 4, 8, 16} {
+		m := bayer(n)
+		if len(m) != n {
+			t.Fatalf("bayer(%d) has %d rows", n, len(m))
+		}
+		// each value 0 to n*n-1 appears once
+		seen := make([]bool, n*n)
+		for _, row := range m {
+			if len(row) != n {
+				t.Fatalf("bayer(%d) row length %d", n, len(row))
+			}
+			for _, v := range row {
+				if v < 0 || v >= n*n || seen[v] {
+					t.Fatalf("bayer(%d) value %d", n, v)
+				}
+				seen[v] = true
+			}
+		}
+	}
+}
+
+func TestOrderedSize(t *testing.T) {
+	for _, tc := range []struct{ size, want int }{
+		{-2, 4}, {0, 4}, {1, 1}, {2, 2}, {3, 4}, {5, 8}, {8, 8},
+	} {
+		if got := (Ordered{Size: tc.size}).size(); got != tc.want {
+			t.Errorf("Size %d: got %d, want %d", tc.size, got, tc.want)
+		}
+	}
+}
+
+// orderedGray draws a flat gray with a black and white palette, returning
+// the fraction of white pixels.
+func orderedGray(d Ordered, v uint8) float64 {
+	src := image.NewGray(image.Rect(0, 0, 32, 32))
+	for i := range src.Pix {
+		src.Pix[i] = v
+	}
+	pi := image.NewPaletted(src.Rect, color.Palette{color.Black, color.White})
+	d.Draw(pi, pi.Rect, src, image.Point{})
+	w := 0
+	for _, i := range pi.Pix {
+		w += int(i)
+	}
+	return float64(w) / float64(len(pi.Pix))
+}
+
+func TestOrderedDraw(t *testing.T) {
+	for _, size := range []int{-2, 0, 2, 3, 8} {
+		d := Ordered{Size: size, Spread: 0xffff}
+		// black and white stay pure, mid gray is half dots
+		if f := orderedGray(d, 0); f != 0 {
+			t.Fatalf("Size %d: black %g white", size, f)
+		}
+		if f := orderedGray(d, 255); f != 1 {
+			t.Fatalf("Size %d: white %g white", size, f)
+		}
+		if f := orderedGray(d, 128); f != .5 {
+			t.Fatalf("Size %d: mid gray %g white", size, f)
+		}
+		// a quarter gray has fewer dots than a three quarter gray
+		if f1, f3 := orderedGray(d, 64), orderedGray(d, 192); f1 >= f3 {
+			t.Fatalf("Size %d: quarter gray %g white, three quarter %g", size, f1, f3)
+		}
+	}
+}
+
+func TestOrderedLinear(t *testing.T) {
+	// gray palette in steps of 8
+	var cp color.Palette
+	for v := 0; v < 256; v += 8 {
+		cp = append(cp, color.Gray{uint8(v)})
+	}
+	// spread returns the range of output grays for flat gray v
+	spread := func(d Ordered, v uint8) int {
+		src := image.NewGray(image.Rect(0, 0, 16, 16))
+		for i := range src.Pix {
+			src.Pix[i] = v
+		}
+		pi := image.NewPaletted(src.Rect, cp)
+		d.Draw(pi, pi.Rect, src, image.Point{})
+		lo, hi := 255, 0
+		for _, i := range pi.Pix {
+			g := int(cp[i].(color.Gray).Y)
+			if g < lo {
+				lo = g
+			}
+			if g > hi {
+				hi = g
+			}
+		}
+		return hi - lo
+	}
+	d := Ordered{Size: 4, Spread: 0x2000}
+	dl := Ordered{Size: 4, Spread: 0x2000, Linear: true}
+	// offsets constant in linear light span more gamma encoded values in
+	// shadows and fewer in highlights
+	if g, l := spread(d, 36), spread(dl, 36); l <= g {
+		t.Fatalf("shadow range %d linear, %d gamma", l, g)
+	}
+	if g, l := spread(d, 220), spread(dl, 220); l >= g {
+		t.Fatalf("highlight range %d linear, %d gamma", l, g)
+	}
+}
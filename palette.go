@@ -4,8 +4,10 @@
 package quant
 
 import (
+	"fmt"
 	"image"
 	"image/color"
+	"math"
 )
 
 // Palette is a palette of color.Colors, much like color.Palette of the
@@ -23,6 +25,20 @@ type Palette interface {
 
 var _ Palette = LinearPalette{}
 var _ Palette = TreePalette{}
+var _ Palette = ManhattanPalette{}
+
+// Metric values select a distance used to find nearest colors.
+type Metric int
+
+const (
+	// Euclidean is squared Euclidean distance in RGB space.
+	Euclidean Metric = iota
+	// Manhattan is the sum of absolute channel differences.  It avoids
+	// multiplications and so is faster to compute.  It is a poorer match
+	// to perceived color difference, but for mapping pixels, especially
+	// with dithering, results are often visually indistinguishable.
+	Manhattan
+)
 
 // LinearPalette implements the Palette interface with color.Palette
 // and has no optimizations.
@@ -32,9 +48,41 @@ type LinearPalette struct {
 
 // IndexNear returns the palette index of the nearest palette color.
 //
-// It simply wraps color.Palette.Index.
+// The result is that of color.Palette.Index.
 func (p LinearPalette) IndexNear(c color.Color) int {
-	return p.Palette.Index(c)
+	r, g, b, a := c.RGBA()
+	return p.indexRGBA(r, g, b, a)
+}
+
+// IndexNearRGB returns the palette index of the palette color nearest the
+// opaque color with alpha-premultiplied channel values r, g, b, in the
+// range [0, 0xffff].
+//
+// It is IndexNear for callers with channel values at hand, avoiding
+// constructing a color.Color.
+func (p LinearPalette) IndexNearRGB(r, g, b uint32) int {
+	return p.indexRGBA(r, g, b, 0xffff)
+}
+
+// indexRGBA does the work of IndexNear for channel values.
+func (p LinearPalette) indexRGBA(r, g, b, a uint32) int {
+	// as color.Palette.Index
+	sqDiff := func(x, y uint32) uint32 {
+		d := x - y
+		return (d * d) >> 2
+	}
+	ret, bestSum := 0, uint32(1<<32-1)
+	for i, pc := range p.Palette {
+		pr, pg, pb, pa := pc.RGBA()
+		sum := sqDiff(r, pr) + sqDiff(g, pg) + sqDiff(b, pb) + sqDiff(a, pa)
+		if sum < bestSum {
+			if sum == 0 {
+				return i
+			}
+			ret, bestSum = i, sum
+		}
+	}
+	return ret
 }
 
 // Color near returns the nearest palette color.
@@ -53,6 +101,65 @@ func (p LinearPalette) ColorPalette() color.Palette {
 
 func (p LinearPalette) Len() int { return len(p.Palette) }
 
+// ManhattanPalette implements the Palette interface with color.Palette,
+// like LinearPalette, but finds nearest colors by Manhattan distance.
+//
+// Lookups are faster than with LinearPalette but may pick a color that
+// looks slightly less close than the Euclidean choice.
+type ManhattanPalette struct {
+	color.Palette
+}
+
+// IndexNear returns the palette index of the nearest palette color by
+// Manhattan distance.
+func (p ManhattanPalette) IndexNear(c color.Color) int {
+	r, g, b, a := c.RGBA()
+	return p.indexRGBA(r, g, b, a)
+}
+
+// IndexNearRGB is as LinearPalette.IndexNearRGB, using Manhattan distance.
+func (p ManhattanPalette) IndexNearRGB(r, g, b uint32) int {
+	return p.indexRGBA(r, g, b, 0xffff)
+}
+
+// indexRGBA is color.Palette.Index using Manhattan distance.
+func (p ManhattanPalette) indexRGBA(r, g, b, a uint32) int {
+	abs := func(x int64) int64 {
+		if x < 0 {
+			return -x
+		}
+		return x
+	}
+	ret, min := -1, int64(math.MaxInt64)
+	for i, pc := range p.Palette {
+		pr, pg, pb, pa := pc.RGBA()
+		d := abs(int64(r)-int64(pr)) + abs(int64(g)-int64(pg)) +
+			abs(int64(b)-int64(pb)) + abs(int64(a)-int64(pa))
+		if d < min {
+			ret, min = i, d
+		}
+	}
+	return ret
+}
+
+// ColorNear returns the nearest palette color by Manhattan distance, or
+// nil if the palette is empty.
+func (p ManhattanPalette) ColorNear(c color.Color) color.Color {
+	if len(p.Palette) == 0 {
+		return nil
+	}
+	return p.Palette[p.IndexNear(c)]
+}
+
+// ColorPalette satisfies interface Palette.
+//
+// It simply returns the internal color.Palette.
+func (p ManhattanPalette) ColorPalette() color.Palette {
+	return p.Palette
+}
+
+func (p ManhattanPalette) Len() int { return len(p.Palette) }
+
 // TreePalette implements the Palette interface with a binary tree.
 //
 // XNear methods run in O(log n) time for palette size.
@@ -86,12 +193,38 @@ const (
 )
 
 // IndexNear returns the index of the nearest palette color.
-func (t TreePalette) IndexNear(c color.Color) (i int) {
-	if t.Root == nil {
+func (t TreePalette) IndexNear(c color.Color) int {
+	r, g, b, _ := c.RGBA()
+	return t.IndexNearRGB(r, g, b)
+}
+
+// IndexNearRGB returns the index of the palette color nearest the color
+// with channel values r, g, b, as returned by the RGBA method.
+//
+// It is IndexNear for callers with channel values at hand, avoiding
+// constructing a color.Color.
+func (t TreePalette) IndexNearRGB(r, g, b uint32) int {
+	n := t.Root
+	if n == nil {
 		return -1
 	}
-	t.Search(c, func(leaf *Node) { i = leaf.Index })
-	return
+	var lt bool
+	for n.Type != TLeaf {
+		switch n.Type {
+		case TSplitR:
+			lt = r < n.Split
+		case TSplitG:
+			lt = g < n.Split
+		case TSplitB:
+			lt = b < n.Split
+		}
+		if lt {
+			n = n.Low
+		} else {
+			n = n.High
+		}
+	}
+	return n.Index
 }
 
 // ColorNear returns the nearest palette color.
@@ -142,6 +275,69 @@ func (t TreePalette) ColorPalette() color.Palette {
 	return p
 }
 
+// Validate checks that t is well formed, returning a descriptive error for
+// the first problem found or nil if there are no problems.
+//
+// Split nodes must have a valid split type, a split value no greater than
+// 0x10000, and both children.  Leaves must have distinct indexes in the
+// range 0 to t.Leaves-1 and valid alpha-premultiplied colors.  The number
+// of leaves must be t.Leaves and no node may be reached twice.  A nil Root
+// is valid only with Leaves of 0.
+func (t TreePalette) Validate() error {
+	if t.Root == nil {
+		if t.Leaves != 0 {
+			return fmt.Errorf("quant: nil Root with Leaves %d", t.Leaves)
+		}
+		return nil
+	}
+	seen := map[*Node]bool{}
+	index := map[int]bool{}
+	var v func(n *Node, path string) error
+	v = func(n *Node, path string) error {
+		if n == nil {
+			return fmt.Errorf("quant: nil node at %s", path)
+		}
+		if seen[n] {
+			return fmt.Errorf("quant: node at %s reached twice", path)
+		}
+		seen[n] = true
+		switch n.Type {
+		case TLeaf:
+			if n.Index < 0 || n.Index >= t.Leaves {
+				return fmt.Errorf("quant: leaf at %s has Index %d, not in range 0-%d",
+					path, n.Index, t.Leaves-1)
+			}
+			if index[n.Index] {
+				return fmt.Errorf("quant: leaf at %s has duplicate Index %d",
+					path, n.Index)
+			}
+			index[n.Index] = true
+			if c := n.Color; c.R > c.A || c.G > c.A || c.B > c.A {
+				return fmt.Errorf("quant: leaf at %s has invalid color %v",
+					path, c)
+			}
+			return nil
+		case TSplitR, TSplitG, TSplitB:
+			if n.Split > 0x10000 {
+				return fmt.Errorf("quant: split at %s has value %#x, over 0x10000",
+					path, n.Split)
+			}
+			if err := v(n.Low, path+".Low"); err != nil {
+				return err
+			}
+			return v(n.High, path+".High")
+		}
+		return fmt.Errorf("quant: node at %s has invalid Type %d", path, n.Type)
+	}
+	if err := v(t.Root, "Root"); err != nil {
+		return err
+	}
+	if len(index) != t.Leaves {
+		return fmt.Errorf("quant: %d leaves, Leaves is %d", len(index), t.Leaves)
+	}
+	return nil
+}
+
 // Walk walks the TreePalette calling f for each color.
 func (t TreePalette) Walk(f func(leaf *Node, i int)) {
 	i := 0
@@ -171,3 +367,82 @@ func Paletted(p Palette, img image.Image) *image.Paletted {
 	}
 	return pi
 }
+
+// FromPaletted returns the palette of pi as a Palette, so that helpers
+// of this package work on palettes of decoded GIF or PNG images.
+//
+// The result is a LinearPalette sharing pi.Palette.  For repeated lookups,
+// as when remapping large images to the palette, wrap it with
+// NewCachingPalette.
+func FromPaletted(pi *image.Paletted) Palette {
+	return LinearPalette{Palette: pi.Palette}
+}
+
+// Contains returns true if some color of palette p exactly equals color c
+// at 16 bit precision.  Unlike IndexNear or ColorNear, it does not find
+// a nearest color.
+func Contains(p Palette, c color.Color) bool {
+	r, g, b, a := c.RGBA()
+	eq := func(pc color.Color) bool {
+		pr, pg, pb, pa := pc.RGBA()
+		return pr == r && pg == g && pb == b && pa == a
+	}
+	if t, ok := p.(TreePalette); ok {
+		found := false
+		if t.Root != nil {
+			t.Walk(func(leaf *Node, i int) {
+				if eq(leaf.Color) {
+					found = true
+				}
+			})
+		}
+		return found
+	}
+	for _, pc := range p.ColorPalette() {
+		if eq(pc) {
+			return true
+		}
+	}
+	return false
+}
+
+// Gamut is the bounding box in RGB color space of a set of colors.
+//
+// Alpha is not considered and is set to 0xffff in both Min and Max.
+type Gamut struct {
+	Min, Max color.RGBA64
+}
+
+// Crossfade returns an intermediate frame for a transition from paletted
+// image a to paletted image b.
+//
+// For each pixel, colors of a and b are interpolated by t, where t = 0
+// gives the color of a and t = 1 gives the color of b.  T is clamped to
+// the range [0, 1].  The result is mapped to palette p with IndexNear.
+// Typically a and b both use p.  The returned image has the intersection
+// of the bounds of a and b.  As with Paletted, nil is returned if p has
+// more than 256 colors.
+func Crossfade(a, b *image.Paletted, t float64, p Palette) *image.Paletted {
+	if p.Len() > 256 {
+		return nil
+	}
+	if t < 0 {
+		t = 0
+	} else if t > 1 {
+		t = 1
+	}
+	r := a.Bounds().Intersect(b.Bounds())
+	pi := image.NewPaletted(r, p.ColorPalette())
+	lerp := func(u, v uint32) uint16 {
+		return uint16(float64(u) + t*(float64(v)-float64(u)) + .5)
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			ar, ag, ab, aa := a.At(x, y).RGBA()
+			br, bg, bb, ba := b.At(x, y).RGBA()
+			c := color.RGBA64{lerp(ar, br), lerp(ag, bg), lerp(ab, bb), lerp(aa, ba)}
+			pi.SetColorIndex(x, y, uint8(p.IndexNear(c)))
+		}
+	}
+	return pi
+}
@@ -0,0 +1,54 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package quant
+
+import (
+	"image"
+	"image/color"
+)
+
+// PreviewAndFull quantizes img with q and returns both a preview reduced
+// in size by a factor of scale and the full resolution result, sharing
+// one palette.
+//
+// The palette is derived once, from the full image, by q.Paletted.  The
+// preview is box filtered, averaging scale × scale blocks of pixels of img,
+// then mapped to the nearest colors of the palette, so that it uses
+// exactly the colors of the full result.  The preview has bounds with
+// origin 0, 0 and size rounded up to include partial blocks at the right
+// and bottom edges.  A scale < 1 is taken as 1.
+func PreviewAndFull(img image.Image, q Quantizer, scale int) (preview, full *image.Paletted) {
+	if scale < 1 {
+		scale = 1
+	}
+	full = q.Paletted(img)
+	preview = Paletted(LinearPalette{Palette: full.Palette}, downsample(img, scale))
+	return
+}
+
+// downsample returns img reduced in size by averaging s × s blocks of
+// pixels.  Blocks at the right and bottom edges may be partial.
+func downsample(img image.Image, s int) *image.RGBA64 {
+	b := img.Bounds()
+	sm := image.NewRGBA64(image.Rect(0, 0, (b.Dx()+s-1)/s, (b.Dy()+s-1)/s))
+	for sy := 0; sy < sm.Rect.Max.Y; sy++ {
+		for sx := 0; sx < sm.Rect.Max.X; sx++ {
+			blk := image.Rect(sx*s, sy*s, sx*s+s, sy*s+s).Add(b.Min).Intersect(b)
+			var rs, gs, bs, as uint64
+			for y := blk.Min.Y; y < blk.Max.Y; y++ {
+				for x := blk.Min.X; x < blk.Max.X; x++ {
+					r, g, b, a := img.At(x, y).RGBA()
+					rs += uint64(r)
+					gs += uint64(g)
+					bs += uint64(b)
+					as += uint64(a)
+				}
+			}
+			n := uint64(blk.Dx() * blk.Dy())
+			sm.SetRGBA64(sx, sy, color.RGBA64{
+				uint16(rs / n), uint16(gs / n), uint16(bs / n), uint16(as / n)})
+		}
+	}
+	return sm
+}
@@ -1,17 +1,24 @@
 package quant_test
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
 	"image/png"
+	"math"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"testing"
 
 	"github.com/soniakeys/quant"
+	"github.com/soniakeys/quant/internal/testimage"
+	"github.com/soniakeys/quant/mean"
 	"github.com/soniakeys/quant/median"
 )
 
@@ -104,3 +111,1087 @@ func TestDitherMedianPalette(t *testing.T) {
 		}
 	}
 }
+
+// TestNoiseShaped tests that NoiseShaped results are reproducible by seed.
+func TestNoiseShaped(t *testing.T) {
+	img := testimage.Synthetic()
+	b := img.Bounds()
+	p := median.Quantizer(16).Quantize(make(color.Palette, 0, 16), img)
+	draw := func(seed uint64) *image.Paletted {
+		pi := image.NewPaletted(b, p)
+		quant.NoiseShaped{Amplitude: 0x1000, Seed: seed}.Draw(pi, b, img, b.Min)
+		return pi
+	}
+	p1 := draw(1)
+	if !bytes.Equal(p1.Pix, draw(1).Pix) {
+		t.Error("same seed, different results")
+	}
+	if bytes.Equal(p1.Pix, draw(2).Pix) {
+		t.Error("different seeds, same results")
+	}
+}
+
+func TestContains(t *testing.T) {
+	img := testimage.Synthetic()
+	for _, p := range []quant.Palette{
+		median.Quantizer(16).Palette(img),
+		quant.LinearPalette{Palette: color.Palette{color.White, color.Black}},
+	} {
+		for _, c := range p.ColorPalette() {
+			if !quant.Contains(p, c) {
+				t.Errorf("%T: palette color %v not found", p, c)
+			}
+		}
+		if quant.Contains(p, color.RGBA64{1, 2, 3, 0xffff}) {
+			t.Errorf("%T: non-palette color found", p)
+		}
+	}
+}
+
+func TestKMeansFrozen(t *testing.T) {
+	img := testimage.Synthetic()
+	p := median.Quantizer(16).Palette(img)
+	// reserve a color not in the image at index 0
+	cp := p.ColorPalette()
+	cp[0] = color.RGBA64{0x1234, 0x5678, 0x9abc, 0xffff}
+	k := quant.KMeans(img, quant.LinearPalette{Palette: cp}, 10, []int{0})
+	if k.Palette[0] != cp[0] {
+		t.Errorf("frozen color moved to %v", k.Palette[0])
+	}
+	if k.Len() != len(cp) {
+		t.Errorf("palette has %d colors, want %d", k.Len(), len(cp))
+	}
+	// an empty palette is returned unchanged
+	if k := quant.KMeans(img, quant.LinearPalette{}, 10, []int{0}); k.Len() != 0 {
+		t.Errorf("empty palette gave %d colors", k.Len())
+	}
+}
+
+// TestOrderByProximity tests that reindexing an image for the reordered
+// palette leaves pixel colors unchanged.
+func TestOrderByProximity(t *testing.T) {
+	img := testimage.Synthetic()
+	pi, p := median.Quantizer(16).ImageAndPalette(img)
+	b := pi.Bounds()
+	var want []color.Color
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			want = append(want, pi.At(x, y))
+		}
+	}
+	op, remap := quant.OrderByProximity(p)
+	quant.Reindex(pi, op, remap)
+	i := 0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if pi.At(x, y) != want[i] {
+				t.Fatalf("pixel %d, %d changed", x, y)
+			}
+			i++
+		}
+	}
+	// indices beyond remap are left alone
+	pi.Pix[0] = uint8(len(remap))
+	quant.Reindex(pi, op, remap)
+	if pi.Pix[0] != uint8(len(remap)) {
+		t.Fatalf("out of palette index changed to %d", pi.Pix[0])
+	}
+}
+
+func TestCountColors(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 10, 10))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i % 30)
+	}
+	if n := quant.CountColors(img, 256); n != 30 {
+		t.Errorf("got %d, want 30", n)
+	}
+	if n := quant.CountColors(img, 20); n != 20 {
+		t.Errorf("limit 20: got %d", n)
+	}
+}
+
+func TestNewQuantizer(t *testing.T) {
+	names := quant.Quantizers()
+	if len(names) != 2 || names[0] != "mean" || names[1] != "median" {
+		t.Fatalf("Quantizers() = %v", names)
+	}
+	q, err := quant.NewQuantizer("median", 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q != median.Quantizer(16) {
+		t.Fatalf("got %#v", q)
+	}
+	if _, err := quant.NewQuantizer("nope", 16); err == nil {
+		t.Fatal("no error for unknown quantizer")
+	}
+}
+
+func TestTileDitherer(t *testing.T) {
+	img := testimage.Synthetic()
+	b := img.Bounds()
+	cp := median.Quantizer(16).Quantize(make(color.Palette, 0, 16), img)
+	whole := image.NewPaletted(b, cp)
+	quant.Sierra24A{}.Draw(whole, b, img, b.Min)
+	for _, ts := range []image.Point{{64, 16}, {16, 16}, {24, 10}} {
+		tiled := image.NewPaletted(b, cp)
+		td := quant.NewTileDitherer(quant.Sierra24A{}, b, cp)
+		for y := b.Min.Y; y < b.Max.Y; y += ts.Y {
+			for x := b.Min.X; x < b.Max.X; x += ts.X {
+				r := image.Rect(x, y, x+ts.X, y+ts.Y)
+				pi := td.Dither(img.SubImage(r))
+				draw.Draw(tiled, pi.Rect, pi, pi.Rect.Min, draw.Src)
+			}
+		}
+		if !bytes.Equal(tiled.Pix, whole.Pix) {
+			t.Fatalf("%v tiles differ from whole image", ts)
+		}
+	}
+}
+
+func TestTileDithererEdge(t *testing.T) {
+	// Edge is not detected across tile seams, so the image has edges only
+	// within tiles.  Left of the seam at x = 8 is flat gray 0x1e.  Right of
+	// it rows alternate 0 and 0x3c, an edge from each pixel to the one
+	// below but not to the gray pixels left or down left.
+	img := image.NewGray(image.Rect(0, 0, 16, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 16; x++ {
+			switch {
+			case x < 8:
+				img.SetGray(x, y, color.Gray{0x1e})
+			case y%2 == 1:
+				img.SetGray(x, y, color.Gray{0x3c})
+			}
+		}
+	}
+	var cp color.Palette
+	for i := 0; i < 256; i += 0x18 {
+		cp = append(cp, color.Gray{uint8(i)})
+	}
+	d := quant.Sierra24A{Edge: 0x2000}
+	b := img.Bounds()
+	whole := image.NewPaletted(b, cp)
+	d.Draw(whole, b, img, b.Min)
+	tiled := image.NewPaletted(b, cp)
+	td := quant.NewTileDitherer(d, b, cp)
+	for x := 0; x < 16; x += 8 {
+		pi := td.Dither(img.SubImage(image.Rect(x, 0, x+8, 8)))
+		draw.Draw(tiled, pi.Rect, pi, pi.Rect.Min, draw.Src)
+	}
+	if !bytes.Equal(tiled.Pix, whole.Pix) {
+		t.Fatal("tiles differ from whole image")
+	}
+}
+
+func TestSnap(t *testing.T) {
+	img := testimage.Synthetic()
+	p := median.Quantizer(16).Palette(img)
+	s := quant.Snap(p, quant.WebSafe)
+	if s.Len() != p.Len() {
+		t.Fatalf("Len %d, want %d", s.Len(), p.Len())
+	}
+	for _, c := range s.ColorPalette() {
+		r, g, b, _ := c.RGBA()
+		for _, v := range []uint32{r, g, b} {
+			if v%0x3333 != 0 {
+				t.Fatalf("%v not on web-safe grid", c)
+			}
+		}
+	}
+	// mapping by tree is unchanged
+	if !bytes.Equal(quant.Paletted(s, img).Pix, quant.Paletted(p, img).Pix) {
+		t.Fatal("snapped tree maps pixels differently")
+	}
+	// grids < 2 leave p unchanged, grids over 65536 are 65536, which
+	// leaves 16 bit opaque colors unchanged
+	for _, g := range []int{1, 0, -3, 0x10000, 1 << 30} {
+		if s := quant.Snap(p, g); !reflect.DeepEqual(s.ColorPalette(), p.ColorPalette()) {
+			t.Fatalf("grid %d changed palette", g)
+		}
+	}
+	l := quant.Snap(quant.LinearPalette{Palette: color.Palette{
+		color.RGBA{0x10, 0x40, 0xf0, 0xff},
+	}}, quant.WebSafe).ColorPalette()
+	if r, g, b, _ := l[0].RGBA(); r != 0 || g != 0x3333 || b != 0xffff {
+		t.Fatalf("got %v", l[0])
+	}
+	// translucent colors snap in non-premultiplied values
+	l = quant.Snap(quant.LinearPalette{Palette: color.Palette{
+		color.NRGBA{0xff, 0xff, 0xff, 0x80},
+		color.NRGBA{0x10, 0x40, 0xf0, 0x80},
+	}}, quant.WebSafe).ColorPalette()
+	for i, want := range []color.NRGBA{
+		{0xff, 0xff, 0xff, 0x80},
+		{0, 0x33, 0xff, 0x80},
+	} {
+		r, g, b, a := l[i].RGBA()
+		if r > a || g > a || b > a {
+			t.Fatalf("invalid premultiplied color %v", l[i])
+		}
+		if got := color.NRGBAModel.Convert(l[i]).(color.NRGBA); got != want {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestUsage(t *testing.T) {
+	pi := image.NewPaletted(image.Rect(0, 0, 8, 8), color.Palette{
+		color.Black, color.White, color.Gray{0x80}})
+	for i := range pi.Pix {
+		pi.Pix[i] = uint8(i % 2)
+	}
+	// subimage stride differs from its width
+	sub := pi.SubImage(image.Rect(1, 1, 4, 3)).(*image.Paletted)
+	want := []int{2, 4, 0}
+	if got := quant.Usage(sub); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestThreshold1Bit(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 32, 32))
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 32; y++ {
+			img.SetGray(x, y, color.Gray{0x80}) // left half gray
+		}
+	}
+	d := quant.Threshold1Bit{Light: color.RGBA{0xff, 0xf8, 0xe0, 0xff}}
+	pi := d.Dither(img)
+	light := 0
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			i := pi.ColorIndexAt(x, y)
+			if x >= 16 && i != 0 {
+				t.Fatalf("black pixel %d,%d dithered light", x, y)
+			}
+			light += int(i)
+		}
+	}
+	if light < 16*32*2/5 || light > 16*32*3/5 {
+		t.Fatalf("%d of %d gray pixels light", light, 16*32)
+	}
+	// Draw maps to dst palette indexes
+	dst := image.NewPaletted(img.Bounds(), color.Palette{
+		color.RGBA{0xff, 0xf8, 0xe0, 0xff}, color.Gray{0x40}, color.Black})
+	d.Draw(dst, dst.Rect, img, image.Point{})
+	for i, x := range dst.Pix {
+		if want := [2]uint8{2, 0}[pi.Pix[i]]; x != want {
+			t.Fatalf("Draw pixel %d index %d, want %d", i, x, want)
+		}
+	}
+}
+
+func TestOptimalPalette(t *testing.T) {
+	img := testimage.Synthetic().SubImage(image.Rect(0, 0, 24, 24))
+	sqErr := func(p quant.Palette) (e uint64) {
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				r0, g0, b0, _ := img.At(x, y).RGBA()
+				r1, g1, b1, _ := p.ColorNear(img.At(x, y)).RGBA()
+				for _, d := range []int64{
+					int64(r0) - int64(r1),
+					int64(g0) - int64(g1),
+					int64(b0) - int64(b1),
+				} {
+					e += uint64(d * d)
+				}
+			}
+		}
+		return
+	}
+	p := quant.OptimalPalette(img, 8, 4)
+	if p.Len() != 8 {
+		t.Fatalf("%d colors, want 8", p.Len())
+	}
+	if o, m := sqErr(p), sqErr(median.Quantizer(8).Palette(img)); o > m {
+		t.Fatalf("optimal error %d exceeds median cut error %d", o, m)
+	}
+	// fewer distinct colors than n
+	img2 := image.NewGray(image.Rect(0, 0, 4, 4))
+	img2.Pix[3] = 0xff
+	if n := quant.OptimalPalette(img2, 8, 2).Len(); n != 2 {
+		t.Fatalf("%d colors for 2 color image, want 2", n)
+	}
+}
+
+func TestCachingPalette(t *testing.T) {
+	img := testimage.Synthetic()
+	p := median.Quantizer(16).Palette(img)
+	cp := quant.NewCachingPalette(p, 64)
+	b := img.Bounds()
+	for pass := 0; pass < 2; pass++ {
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				c := img.At(x, y)
+				if i, want := cp.IndexNear(c), p.IndexNear(c); i != want {
+					t.Fatalf("IndexNear(%v) = %d, want %d", c, i, want)
+				}
+				if c1, want := cp.ColorNear(c), p.ColorNear(c); c1 != want {
+					t.Fatalf("ColorNear(%v) = %v, want %v", c, c1, want)
+				}
+			}
+		}
+	}
+	if !bytes.Equal(quant.Paletted(cp, img).Pix, quant.Paletted(p, img).Pix) {
+		t.Fatal("Paletted results differ")
+	}
+}
+
+func TestOrderByPopulation(t *testing.T) {
+	pi := median.Quantizer(16).Paletted(testimage.Synthetic())
+	orig := image.NewPaletted(pi.Rect, pi.Palette)
+	copy(orig.Pix, pi.Pix)
+	p, remap := quant.OrderByPopulation(pi)
+	quant.Reindex(pi, p, remap)
+	u := quant.Usage(pi)
+	for i := 1; i < len(u); i++ {
+		if u[i] > u[i-1] {
+			t.Fatalf("usage not descending: %v", u)
+		}
+	}
+	for i := range pi.Pix {
+		if pi.Palette[pi.Pix[i]] != orig.Palette[orig.Pix[i]] {
+			t.Fatalf("pixel %d changed color", i)
+		}
+	}
+}
+
+func TestOrderCanonical(t *testing.T) {
+	cp := median.Quantizer(16).Palette(testimage.Synthetic()).ColorPalette()
+	rev := make(color.Palette, len(cp))
+	for i, c := range cp {
+		rev[len(cp)-1-i] = c
+	}
+	p, remap := quant.OrderCanonical(quant.LinearPalette{Palette: cp})
+	p2, _ := quant.OrderCanonical(quant.LinearPalette{Palette: rev})
+	if !reflect.DeepEqual(p, p2) {
+		t.Fatal("order depends on input order")
+	}
+	for i, c := range cp {
+		if p.Palette[remap[i]] != c {
+			t.Fatalf("remap[%d] = %d, wrong color", i, remap[i])
+		}
+	}
+	for i := 1; i < len(p.Palette); i++ {
+		r0, g0, _, _ := p.Palette[i-1].RGBA()
+		r1, g1, _, _ := p.Palette[i].RGBA()
+		if r1 < r0 || r1 == r0 && g1 < g0 {
+			t.Fatalf("colors %d, %d out of order", i-1, i)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	p := median.Quantizer(16).Palette(testimage.Synthetic()).(quant.TreePalette)
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	leaf := func(i int) *quant.Node {
+		return &quant.Node{Index: i, Color: color.RGBA64{A: 0xffff}}
+	}
+	for _, bad := range []quant.TreePalette{
+		{Leaves: 1},
+		{Leaves: 2, Root: &quant.Node{Type: quant.TSplitR, Low: leaf(0)}},
+		{Leaves: 2, Root: &quant.Node{Type: 7, Low: leaf(0), High: leaf(1)}},
+		{Leaves: 2, Root: &quant.Node{Type: quant.TSplitG, Split: 0x20000,
+			Low: leaf(0), High: leaf(1)}},
+		{Leaves: 2, Root: &quant.Node{Type: quant.TSplitB,
+			Low: leaf(0), High: leaf(0)}},
+		{Leaves: 2, Root: &quant.Node{Type: quant.TSplitB,
+			Low: leaf(0), High: leaf(2)}},
+		{Leaves: 3, Root: &quant.Node{Type: quant.TSplitB,
+			Low: leaf(0), High: leaf(1)}},
+		{Leaves: 1, Root: &quant.Node{Color: color.RGBA64{R: 1}}},
+	} {
+		if bad.Validate() == nil {
+			t.Errorf("no error for %+v", bad)
+		}
+	}
+}
+
+func TestMSE(t *testing.T) {
+	a := image.NewGray(image.Rect(0, 0, 2, 2))
+	b := image.NewGray(image.Rect(0, 0, 2, 2))
+	if e := quant.MSE(a, b); e != 0 {
+		t.Fatalf("MSE of equal images = %g", e)
+	}
+	b.Pix[0] = 4 // squared error 16 in each of 3 channels of 1 of 4 pixels
+	if e := quant.MSE(a, b); e != 4 {
+		t.Fatalf("MSE = %g, want 4", e)
+	}
+}
+
+// BenchmarkQuantizers runs each registered quantizer on the synthetic test
+// image, reporting the mean squared error of the result with the time.
+func BenchmarkQuantizers(b *testing.B) {
+	img := testimage.Synthetic()
+	for _, name := range quant.Quantizers() {
+		for _, n := range []int{16, 64, 256} {
+			b.Run(fmt.Sprintf("%s/%d", name, n), func(b *testing.B) {
+				q, err := quant.NewQuantizer(name, n)
+				if err != nil {
+					b.Fatal(err)
+				}
+				var pi *image.Paletted
+				for i := 0; i < b.N; i++ {
+					pi = q.Paletted(img)
+				}
+				b.ReportMetric(quant.MSE(img, pi), "MSE")
+			})
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	img := testimage.Synthetic()
+	tp := median.Quantizer(16).Palette(img).(quant.TreePalette)
+	b, err := json.Marshal(tp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tp2 quant.TreePalette
+	if err := json.Unmarshal(b, &tp2); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tp2, tp) {
+		t.Fatal("TreePalette did not round trip")
+	}
+	lp := quant.LinearPalette{Palette: tp.ColorPalette()}
+	if b, err = json.Marshal(lp); err != nil {
+		t.Fatal(err)
+	}
+	var lp2 quant.LinearPalette
+	if err := json.Unmarshal(b, &lp2); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(lp2, lp) {
+		t.Fatal("LinearPalette did not round trip")
+	}
+	mp := quant.ManhattanPalette{Palette: lp.Palette}
+	if b, err = json.Marshal(mp); err != nil {
+		t.Fatal(err)
+	}
+	var mp2 quant.ManhattanPalette
+	if err := json.Unmarshal(b, &mp2); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mp2, mp) {
+		t.Fatal("ManhattanPalette did not round trip")
+	}
+	// malformed tree
+	bad := `{"leaves":2,"root":{"channel":"r","split":5,"low":{"index":0}}}`
+	if err := json.Unmarshal([]byte(bad), &tp2); err == nil {
+		t.Fatal("no error for split node missing child")
+	}
+}
+
+func TestGradientMap(t *testing.T) {
+	// horizontal luminance ramp
+	img := image.NewGray(image.Rect(0, 0, 64, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetGray(x, y, color.Gray{uint8(x * 4)})
+		}
+	}
+	navy := color.RGBA{0x10, 0x20, 0x60, 0xff}
+	orange := color.RGBA{0xff, 0x90, 0x20, 0xff}
+	cream := color.RGBA{0xff, 0xf8, 0xe0, 0xff}
+	d := quant.GradientMap{Stops: color.Palette{navy, orange, cream}}
+	pi := d.Dither(img)
+	// dark end is navy, bright end cream, middle mostly orange
+	for y := 0; y < 8; y++ {
+		if i := pi.ColorIndexAt(0, y); i != 0 {
+			t.Fatalf("row %d dark end index %d", y, i)
+		}
+		if i := pi.ColorIndexAt(63, y); i != 2 {
+			t.Fatalf("row %d bright end index %d", y, i)
+		}
+	}
+	if u := quant.Usage(pi.SubImage(image.Rect(28, 0, 36, 8)).(*image.Paletted)); u[1] < 48 {
+		t.Fatalf("middle usage %v", u)
+	}
+	// Draw with stops from dst palette
+	dst := image.NewPaletted(img.Rect, color.Palette{navy, orange, cream})
+	quant.GradientMap{}.Draw(dst, dst.Rect, img, image.Point{})
+	if !bytes.Equal(dst.Pix, pi.Pix) {
+		t.Fatal("Draw differs from Dither")
+	}
+}
+
+func TestIndexedImage(t *testing.T) {
+	cp := make(color.Palette, 300)
+	for i := range cp {
+		cp[i] = color.RGBA64{uint16(i * 200), uint16(i * 100), 0, 0xffff}
+	}
+	img := image.NewRGBA64(image.Rect(2, 3, 22, 18))
+	for y := 3; y < 18; y++ {
+		for x := 2; x < 22; x++ {
+			img.Set(x, y, cp[(x*15+y)%300])
+		}
+	}
+	ii := quant.Indexed(quant.LinearPalette{Palette: cp}, img)
+	for y := 3; y < 18; y++ {
+		for x := 2; x < 22; x++ {
+			if want := uint16((x*15 + y) % 300); ii.ColorIndexAt(x, y) != want {
+				t.Fatalf("index at %d,%d = %d, want %d",
+					x, y, ii.ColorIndexAt(x, y), want)
+			}
+			if ii.At(x, y) != img.At(x, y) {
+				t.Fatalf("color at %d,%d = %v, want %v",
+					x, y, ii.At(x, y), img.At(x, y))
+			}
+		}
+	}
+	sub := ii.SubImage(image.Rect(5, 5, 8, 9)).(*quant.IndexedImage)
+	sub.SetColorIndex(6, 7, 299)
+	if ii.ColorIndexAt(6, 7) != 299 || sub.At(4, 4) != cp[0] {
+		t.Fatal("SubImage")
+	}
+	// out of bounds is Palette[0], as with image.Paletted
+	if ii.At(-1, 0) != cp[0] {
+		t.Fatal("At out of bounds")
+	}
+}
+
+func TestContactSheet(t *testing.T) {
+	img := testimage.Synthetic()
+	ns := []int{2, 16, 64}
+	sheet := quant.ContactSheet(img, mean.Quantizer(8), ns).(interface {
+		image.Image
+		SubImage(image.Rectangle) image.Image
+	})
+	b := img.Bounds()
+	// 2x2 tiles of the image plus label, separated by 4 pixel gaps
+	if want := image.Rect(0, 0, 2*b.Dx()+12, 2*(b.Dy()+14)+12); sheet.Bounds() != want {
+		t.Fatalf("bounds %v, want %v", sheet.Bounds(), want)
+	}
+	for i, n := range ns {
+		at := image.Pt(4+i%2*(b.Dx()+4), 4+i/2*(b.Dy()+18))
+		tile := sheet.SubImage(b.Sub(b.Min).Add(at))
+		if c := quant.CountColors(tile, 256); c > n || c < 2 {
+			t.Fatalf("n = %d: tile has %d colors", n, c)
+		}
+		// some pixel of the label is drawn in black
+		lb := image.Rect(0, b.Dy(), b.Dx(), b.Dy()+14).Add(at)
+		black := false
+		for y := lb.Min.Y; y < lb.Max.Y; y++ {
+			for x := lb.Min.X; x < lb.Max.X; x++ {
+				black = black || sheet.At(x, y) == color.RGBA{0, 0, 0, 0xff}
+			}
+		}
+		if !black {
+			t.Fatalf("n = %d: no label", n)
+		}
+	}
+}
+
+func TestFromPaletted(t *testing.T) {
+	img := testimage.Synthetic()
+	pi := mean.Quantizer(16).Paletted(img)
+	p := quant.FromPaletted(pi)
+	if p.Len() != len(pi.Palette) {
+		t.Fatalf("Len %d, want %d", p.Len(), len(pi.Palette))
+	}
+	for i, c := range pi.Palette {
+		if p.IndexNear(c) != i {
+			t.Fatalf("IndexNear(palette[%d]) = %d", i, p.IndexNear(c))
+		}
+	}
+	// remapping the image to its own palette reproduces it
+	if !reflect.DeepEqual(quant.Paletted(p, pi), pi) {
+		t.Fatal("remap differs")
+	}
+}
+
+func TestErrorClamp(t *testing.T) {
+	// saturated red band left of a gray area, with a palette far from red
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			c := color.RGBA{0x80, 0x80, 0x80, 0xff}
+			if x < 16 {
+				c = color.RGBA{0xff, 0, 0, 0xff}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	cp := color.Palette{color.Black, color.White,
+		color.RGBA{0x80, 0x80, 0x80, 0xff}, color.RGBA{0xc0, 0x80, 0x80, 0xff}}
+	// count pixels of the gray area not drawn gray
+	bleed := func(d quant.Sierra24A) int {
+		pi := image.NewPaletted(img.Rect, cp)
+		d.Draw(pi, pi.Rect, img, image.Point{})
+		n := 0
+		for y := 0; y < 64; y++ {
+			for _, x := range pi.Pix[y*64+16 : y*64+64] {
+				if x != 2 {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	b0 := bleed(quant.Sierra24A{})
+	b1 := bleed(quant.Sierra24A{ErrorClamp: 0x1000})
+	if b0 == 0 || b1 >= b0 {
+		t.Fatalf("clamped bleed %d, unclamped %d", b1, b0)
+	}
+}
+
+func TestDrawChecked(t *testing.T) {
+	img := testimage.Synthetic()
+	cp := make(color.Palette, 300)
+	for i := range cp {
+		cp[i] = color.Gray16{uint16(i * 200)}
+	}
+	pi := image.NewPaletted(img.Rect, cp)
+	d := quant.Sierra24A{}
+	err := d.DrawChecked(pi, pi.Rect, img, img.Rect.Min)
+	if !errors.Is(err, quant.ErrPaletteSize) {
+		t.Fatalf("got %v, want ErrPaletteSize", err)
+	}
+	pi.Palette = cp[:256]
+	if err := d.DrawChecked(pi, pi.Rect, img, img.Rect.Min); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRemapAll(t *testing.T) {
+	img := testimage.Synthetic()
+	ims := []*image.Paletted{
+		mean.Quantizer(16).Paletted(img),
+		mean.Quantizer(8).Paletted(img),
+	}
+	shared := mean.Quantizer(32).Palette(img)
+	out, e := quant.RemapAll(ims, shared)
+	if len(out) != 2 {
+		t.Fatalf("%d images", len(out))
+	}
+	// error is the pixel-weighted MSE between originals and remapped
+	want := (quant.MSE(ims[0], out[0]) + quant.MSE(ims[1], out[1])) / 2
+	if math.Abs(e-want) > 1e-9*want || e == 0 {
+		t.Fatalf("error %g, want %g", e, want)
+	}
+	for _, o := range out {
+		if !reflect.DeepEqual(o.Palette, shared.ColorPalette()) {
+			t.Fatal("palette not shared")
+		}
+	}
+	// a worse candidate palette has greater error
+	if _, e2 := quant.RemapAll(ims, mean.Quantizer(4).Palette(img)); e2 <= e {
+		t.Fatalf("4 color error %g, 32 color %g", e2, e)
+	}
+}
+
+func TestSierraScale(t *testing.T) {
+	img := testimage.Synthetic()
+	cp := mean.Quantizer(8).Quantize(make(color.Palette, 0, 8), img)
+	pi := image.NewPaletted(img.Rect, cp)
+	quant.Sierra24A{Scale: 2}.Draw(pi, pi.Rect, img, img.Rect.Min)
+	// every 2x2 block is one index
+	for y := 0; y < 64; y += 2 {
+		for x := 0; x < 64; x += 2 {
+			i := pi.ColorIndexAt(x, y)
+			if pi.ColorIndexAt(x+1, y) != i || pi.ColorIndexAt(x, y+1) != i ||
+				pi.ColorIndexAt(x+1, y+1) != i {
+				t.Fatalf("block at %d,%d not one index", x, y)
+			}
+		}
+	}
+	// error is comparable to undithered mapping
+	if e := quant.MSE(img, pi); e == 0 || e > 2*quant.MSE(img, quant.Paletted(
+		quant.LinearPalette{Palette: cp}, img)) {
+		t.Fatalf("MSE %g", e)
+	}
+	// odd size, partial blocks at the edges
+	odd := image.NewNRGBA(image.Rect(0, 0, 37, 21))
+	draw.Draw(odd, odd.Rect, img, image.Pt(3, 5), draw.Src)
+	pi = image.NewPaletted(odd.Rect, cp)
+	quant.Sierra24A{Scale: 3}.Draw(pi, pi.Rect, odd, image.Point{})
+	if pi.ColorIndexAt(36, 20) != pi.ColorIndexAt(36, 19) {
+		t.Fatal("partial block not one index")
+	}
+}
+
+func TestSierra3(t *testing.T) {
+	// horizontal gray ramp, dithered to black and white
+	img := image.NewGray(image.Rect(0, 0, 64, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetGray(x, y, color.Gray{uint8(x * 4)})
+		}
+	}
+	cp := color.Palette{color.Black, color.White}
+	var ref *image.Paletted
+	for _, d := range []draw.Drawer{
+		quant.Sierra24A{}, quant.Sierra2{}, quant.Sierra3{},
+	} {
+		pi := image.NewPaletted(img.Rect, cp)
+		d.Draw(pi, pi.Rect, img, image.Point{})
+		// each column averages near its source gray
+		for x := 0; x < 64; x += 8 {
+			w := 0
+			for y := 0; y < 32; y++ {
+				w += int(pi.Pix[y*64+x])
+			}
+			if got, want := w*255/32, x*4; got < want-48 || got > want+48 {
+				t.Fatalf("%T column %d: %d white of 32", d, x, w)
+			}
+		}
+		if ref == nil {
+			ref = pi
+		} else if reflect.DeepEqual(pi.Pix, ref.Pix) {
+			t.Fatalf("%T same as Sierra24A", d)
+		}
+	}
+}
+
+func TestWidestAxis(t *testing.T) {
+	for _, tc := range []struct {
+		colors   []color.Color
+		axis     int
+		min, max uint32
+	}{
+		{nil, quant.AxisG, 0, 0},
+		{[]color.Color{color.RGBA{10, 20, 30, 255}}, quant.AxisG, 20 * 0x101, 20 * 0x101},
+		{[]color.Color{color.RGBA{10, 20, 30, 255}, color.RGBA{200, 40, 0, 255}},
+			quant.AxisR, 10 * 0x101, 200 * 0x101},
+		{[]color.Color{color.RGBA{10, 20, 30, 255}, color.RGBA{0, 40, 250, 255}},
+			quant.AxisB, 30 * 0x101, 250 * 0x101},
+		// ties favor green, then red
+		{[]color.Color{color.Black, color.White}, quant.AxisG, 0, 0xffff},
+		{[]color.Color{color.RGBA{0, 0, 0, 255}, color.RGBA{255, 0, 255, 255}},
+			quant.AxisR, 0, 0xffff},
+	} {
+		axis, min, max := quant.WidestAxis(tc.colors)
+		if axis != tc.axis || min != tc.min || max != tc.max {
+			t.Errorf("%v: got %d %#x %#x, want %d %#x %#x", tc.colors,
+				axis, min, max, tc.axis, tc.min, tc.max)
+		}
+	}
+}
+
+func TestPreviewAndFull(t *testing.T) {
+	img := testimage.Synthetic()
+	q := median.Quantizer(32)
+	preview, full := quant.PreviewAndFull(img, q, 5)
+	if !reflect.DeepEqual(full, q.Paletted(img)) {
+		t.Fatal("full result differs from Paletted")
+	}
+	if !reflect.DeepEqual(preview.Palette, full.Palette) {
+		t.Fatal("palette not shared")
+	}
+	// 64 / 5 rounded up
+	if want := image.Rect(0, 0, 13, 13); preview.Rect != want {
+		t.Fatalf("preview bounds %v, want %v", preview.Rect, want)
+	}
+	// a flat image previews as its one color
+	flat := image.NewUniform(color.RGBA{0x40, 0x80, 0xc0, 0xff})
+	src := image.NewRGBA(image.Rect(0, 0, 10, 10))
+	draw.Draw(src, src.Rect, flat, image.Point{}, draw.Src)
+	preview, full = quant.PreviewAndFull(src, q, 4)
+	if preview.Rect.Dx() != 3 || preview.Palette[preview.Pix[8]] != full.Palette[full.Pix[99]] {
+		t.Fatal("flat preview differs from full")
+	}
+}
+
+func TestIndexNearRGB(t *testing.T) {
+	img := testimage.Synthetic()
+	tp := median.Quantizer(16).Palette(img).(quant.TreePalette)
+	lp := quant.LinearPalette{Palette: tp.ColorPalette()}
+	l1 := quant.ManhattanPalette{Palette: lp.Palette}
+	cache := quant.NewCachingPalette(tp, 64)
+	for _, p := range []interface {
+		quant.Palette
+		IndexNearRGB(r, g, b uint32) int
+	}{lp, l1, tp, cache} {
+		for y := 0; y < 64; y += 3 {
+			for x := 0; x < 64; x += 3 {
+				c := img.At(x, y)
+				r, g, b, _ := c.RGBA()
+				if got, want := p.IndexNearRGB(r, g, b), p.IndexNear(c); got != want {
+					t.Fatalf("%T at %d,%d: got %d, want %d", p, x, y, got, want)
+				}
+			}
+		}
+	}
+	// LinearPalette matches color.Palette.Index
+	c := color.RGBA{0x12, 0x34, 0x56, 0xff}
+	if got, want := lp.IndexNearRGB(0x1212, 0x3434, 0x5656), lp.Palette.Index(c); got != want {
+		t.Fatalf("got %d, want %d", got, want)
+	}
+}
+
+func TestManhattan(t *testing.T) {
+	// from black, gray is nearer by Euclidean distance and red by
+	// Manhattan distance
+	cp := color.Palette{
+		color.RGBA{0x60, 0x60, 0x60, 0xff},
+		color.RGBA{0xb0, 0, 0, 0xff},
+	}
+	if i := (quant.LinearPalette{Palette: cp}).IndexNear(color.Black); i != 0 {
+		t.Fatalf("Euclidean index %d, want 0", i)
+	}
+	p := quant.ManhattanPalette{Palette: cp}
+	if i := p.IndexNear(color.Black); i != 1 {
+		t.Fatalf("Manhattan index %d, want 1", i)
+	}
+	if c := p.ColorNear(color.Black); c != cp[1] {
+		t.Fatalf("Manhattan ColorNear %v, want %v", c, cp[1])
+	}
+}
+
+func TestSierraManhattan(t *testing.T) {
+	img := testimage.Synthetic()
+	cp := median.Quantizer(16).Quantize(make(color.Palette, 0, 16), img)
+	mse := func(d quant.Sierra24A) float64 {
+		pi := image.NewPaletted(img.Rect, cp)
+		d.Draw(pi, pi.Rect, img, img.Rect.Min)
+		for _, i := range pi.Pix {
+			if int(i) >= len(cp) {
+				t.Fatalf("index %d out of palette", i)
+			}
+		}
+		return quant.MSE(img, pi)
+	}
+	l2 := mse(quant.Sierra24A{})
+	l1 := mse(quant.Sierra24A{Metric: quant.Manhattan})
+	if l1 == 0 || l1 > 1.5*l2 {
+		t.Fatalf("Manhattan MSE %g, Euclidean %g", l1, l2)
+	}
+}
+
+func TestCrossfade(t *testing.T) {
+	var cp color.Palette
+	for v := 0; v < 256; v += 0x11 {
+		cp = append(cp, color.Gray{uint8(v)})
+	}
+	p := quant.LinearPalette{Palette: cp}
+	a := image.NewPaletted(image.Rect(0, 0, 8, 8), cp)
+	b := image.NewPaletted(image.Rect(2, 2, 10, 10), cp)
+	for i := range b.Pix {
+		b.Pix[i] = 15 // white
+	}
+	for _, tc := range []struct {
+		t    float64
+		want uint8
+	}{
+		{0, 0}, {1, 15}, {.4, 6}, {-3, 0}, {7, 15},
+	} {
+		pi := quant.Crossfade(a, b, tc.t, p)
+		if pi.Rect != image.Rect(2, 2, 8, 8) {
+			t.Fatalf("bounds %v", pi.Rect)
+		}
+		for _, i := range pi.Pix {
+			if i != tc.want {
+				t.Fatalf("t = %g: index %d, want %d", tc.t, i, tc.want)
+			}
+		}
+	}
+}
+
+func TestSierraEdge(t *testing.T) {
+	// a flat gray needing dithering, left of a flat light gray exactly in
+	// the palette
+	img := image.NewGray(image.Rect(0, 0, 64, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 64; x++ {
+			v := uint8(0x70)
+			if x >= 32 {
+				v = 0xc0
+			}
+			img.SetGray(x, y, color.Gray{v})
+		}
+	}
+	cp := color.Palette{color.Black, color.White,
+		color.Gray{0x40}, color.Gray{0xc0}}
+	draw := func(d quant.Sierra24A) *image.Paletted {
+		pi := image.NewPaletted(img.Rect, cp)
+		d.Draw(pi, pi.Rect, img, image.Point{})
+		return pi
+	}
+	// count pixels of the light area not drawn light gray
+	bleed := func(pi *image.Paletted) int {
+		n := 0
+		for y := 0; y < 32; y++ {
+			for _, i := range pi.Pix[y*64+32 : y*64+64] {
+				if i != 3 {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	b0 := bleed(draw(quant.Sierra24A{}))
+	pi := draw(quant.Sierra24A{Edge: 0x2000})
+	if b0 == 0 || bleed(pi) != 0 {
+		t.Fatalf("edge-aware bleed %d, default %d", bleed(pi), b0)
+	}
+	// the dark area is still dithered
+	u := quant.Usage(pi)
+	if u[2] == 0 || u[3] <= 32*32 {
+		t.Fatalf("usage %v", u)
+	}
+	// where neighbors differ less than Edge, results are unchanged
+	grad := testimage.Synthetic()
+	gp := median.Quantizer(16).Quantize(make(color.Palette, 0, 16), grad)
+	p0 := image.NewPaletted(grad.Rect, gp)
+	quant.Sierra24A{}.Draw(p0, p0.Rect, grad, grad.Rect.Min)
+	p1 := image.NewPaletted(grad.Rect, gp)
+	quant.Sierra24A{Edge: 0xffff}.Draw(p1, p1.Rect, grad, grad.Rect.Min)
+	if !bytes.Equal(p0.Pix, p1.Pix) {
+		t.Fatal("Edge with no edges changed result")
+	}
+}
+
+func TestAutoDither(t *testing.T) {
+	flat := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	draw.Draw(flat, flat.Bounds(), &image.Uniform{color.RGBA{0x40, 0x80, 0xc0, 0xff}}, image.Point{}, draw.Src)
+	if d := quant.AutoDither(flat); d != draw.Src {
+		t.Fatalf("flat fill: %T", d)
+	}
+	// one pixel black and white checkerboard, no identical neighbors
+	hard := image.NewGray(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			if (x+y)%2 == 0 {
+				hard.SetGray(x, y, color.Gray{0xff})
+			}
+		}
+	}
+	if _, ok := quant.AutoDither(hard).(quant.Ordered); !ok {
+		t.Fatalf("hard edges: %T", quant.AutoDither(hard))
+	}
+	// smooth gradient, every neighbor slightly different
+	grad := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			grad.SetRGBA(x, y, color.RGBA{uint8(x * 4), uint8(y * 4), uint8(x + y), 0xff})
+		}
+	}
+	if _, ok := quant.AutoDither(grad).(quant.Sierra24A); !ok {
+		t.Fatalf("gradient: %T", quant.AutoDither(grad))
+	}
+}
+
+func TestAdaptiveSierra24A(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			img.SetRGBA(x, y, color.RGBA{0xa0 + uint8(x/2), 0x40 + uint8(y/2), 0x30, 0xff})
+		}
+	}
+	// a poor palette, far from the reddish image
+	cp := color.Palette{
+		color.RGBA{0, 0, 0, 0xff},
+		color.RGBA{0xff, 0xff, 0xff, 0xff},
+		color.RGBA{0x80, 0x80, 0x80, 0xff},
+		color.RGBA{0, 0, 0xff, 0xff},
+	}
+	orig := append(color.Palette{}, cp...)
+	if _, ok := interface{}(quant.AdaptiveSierra24A{}).(draw.Drawer); ok {
+		t.Fatal("AdaptiveSierra24A is a draw.Drawer, which would not adapt")
+	}
+	pi, ap := quant.AdaptiveSierra24A{}.Dither(img, cp)
+	if !reflect.DeepEqual(cp, orig) {
+		t.Fatal("cp modified")
+	}
+	if len(ap) != len(cp) || !reflect.DeepEqual(pi.Palette, ap) {
+		t.Fatal("adapted palette not palette of image")
+	}
+	// nearest palette color to the image center moves closer
+	dist := func(p color.Palette) float64 {
+		c := img.At(32, 32)
+		r0, g0, b0, _ := c.RGBA()
+		r1, g1, b1, _ := p.Convert(c).RGBA()
+		dr, dg, db := float64(r0)-float64(r1), float64(g0)-float64(g1), float64(b0)-float64(b1)
+		return dr*dr + dg*dg + db*db
+	}
+	if d0, d1 := dist(cp), dist(ap); d1 >= d0 {
+		t.Fatalf("palette did not move toward image: %g >= %g", d1, d0)
+	}
+	plain := image.NewPaletted(img.Bounds(), cp)
+	quant.Sierra24A{}.Draw(plain, plain.Bounds(), img, image.Point{})
+	if ea, ep := quant.MSE(img, pi), quant.MSE(img, plain); ea >= ep {
+		t.Fatalf("adaptive MSE %g, plain %g", ea, ep)
+	}
+}
+
+func TestErrorImage(t *testing.T) {
+	cp := color.Palette{
+		color.RGBA{0x40, 0x40, 0x40, 0xff},
+		color.RGBA{0xc0, 0x20, 0x80, 0xff},
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			img.Set(x, y, cp[(x+y)%2])
+		}
+	}
+	g := quant.ErrorImage(img, quant.LinearPalette{Palette: cp})
+	if g.Bounds() != img.Bounds() {
+		t.Fatal("bounds", g.Bounds())
+	}
+	for i, v := range g.Pix {
+		if v != 0 {
+			t.Fatalf("exact palette, pixel %d error %d", i, v)
+		}
+	}
+	// offset of 3, 4, 0 from the nearest palette color is distance 5.
+	img.SetRGBA(2, 3, color.RGBA{0x43, 0x44, 0x40, 0xff})
+	g = quant.ErrorImage(img, quant.LinearPalette{Palette: cp})
+	if v := g.GrayAt(2, 3).Y; v != 5 {
+		t.Fatalf("got %d, want 5", v)
+	}
+	if v := g.GrayAt(3, 3).Y; v != 0 {
+		t.Fatalf("neighbor got %d, want 0", v)
+	}
+}
+
+func TestEInk(t *testing.T) {
+	lum := func(c color.Color) uint8 { return color.GrayModel.Convert(c).(color.Gray).Y }
+	if cp := quant.EInkBWR.ColorPalette(); lum(cp[0]) != 0 || lum(cp[1]) != 0xff ||
+		cp[2] != (color.RGBA{0xff, 0, 0, 0xff}) {
+		t.Fatalf("EInkBWR order %v", cp)
+	}
+	img := testimage.Synthetic()
+	for _, tc := range []struct {
+		name string
+		p    quant.LinearPalette
+		n    int
+	}{
+		{"BW", quant.EInkBW, 2},
+		{"4Gray", quant.EInk4Gray, 4},
+		{"16Gray", quant.EInk16Gray, 16},
+		{"BWR", quant.EInkBWR, 3},
+	} {
+		if tc.p.Len() != tc.n {
+			t.Fatalf("EInk%s: %d colors, want %d", tc.name, tc.p.Len(), tc.n)
+		}
+		// index order is black, white, red, or grays dark to light
+		cp := tc.p.ColorPalette()
+		for i := 1; i < len(cp) && tc.name != "BWR"; i++ {
+			if lum(cp[i]) <= lum(cp[i-1]) {
+				t.Fatalf("EInk%s: color %d not lighter than %d", tc.name, i, i-1)
+			}
+		}
+		if lum(cp[0]) != 0 || tc.name != "BWR" && lum(cp[len(cp)-1]) != 0xff {
+			t.Fatalf("EInk%s: range %v to %v", tc.name, cp[0], cp[len(cp)-1])
+		}
+		pi := quant.EInk(img, tc.p)
+		if pi.Bounds() != img.Bounds() {
+			t.Fatalf("EInk%s: bounds %v", tc.name, pi.Bounds())
+		}
+		if !reflect.DeepEqual(pi.Palette, tc.p.ColorPalette()) {
+			t.Fatalf("EInk%s: palette changed", tc.name)
+		}
+		for _, i := range pi.Pix {
+			if int(i) >= tc.n {
+				t.Fatalf("EInk%s: index %d", tc.name, i)
+			}
+		}
+	}
+}
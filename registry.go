@@ -0,0 +1,59 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package quant
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// registry holds quantizer constructors by name.
+var registry = struct {
+	sync.Mutex
+	m map[string]func(n int) Quantizer
+}{m: map[string]func(n int) Quantizer{}}
+
+// Register makes a quantizer available by name to NewQuantizer.
+//
+// Function f must return a Quantizer for n colors.  Quantizer packages
+// of this source tree register themselves from init functions, so a
+// program needs only import them, perhaps as a blank import,
+//
+//	import _ "github.com/soniakeys/quant/median"
+//
+// Register panics if name is already registered.
+func Register(name string, f func(n int) Quantizer) {
+	registry.Lock()
+	defer registry.Unlock()
+	if _, dup := registry.m[name]; dup {
+		panic("quant: Register called twice for " + name)
+	}
+	registry.m[name] = f
+}
+
+// NewQuantizer returns a registered quantizer by name, for n colors.
+//
+// An error is returned if no quantizer of that name has been registered.
+func NewQuantizer(name string, n int) (Quantizer, error) {
+	registry.Lock()
+	f, ok := registry.m[name]
+	registry.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("quant: unknown quantizer %q", name)
+	}
+	return f(n), nil
+}
+
+// Quantizers returns the names of registered quantizers, sorted.
+func Quantizers() []string {
+	registry.Lock()
+	defer registry.Unlock()
+	names := make([]string, 0, len(registry.m))
+	for name := range registry.m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,60 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package quant
+
+import "image"
+
+// RemapAll remaps paletted images to shared palette p, as for frames of an
+// animation or sprites of an atlas that must share indexes.
+//
+// Each color of the palette of each image is replaced by the color of p
+// found with p.IndexNear.  Returned are new images with palette p and the
+// error introduced, the mean squared error over all pixels of all images
+// in the units of MSE.  Comparing the error of candidate palettes helps
+// choose the best shared palette.
+//
+// If p has more than 256 colors the images cannot be represented.  Nil
+// images are returned then, but the error is still computed.
+func RemapAll(ims []*image.Paletted, p Palette) ([]*image.Paletted, float64) {
+	cp := p.ColorPalette()
+	sp := newSPalette(cp)
+	var out []*image.Paletted
+	if len(cp) <= 256 {
+		out = make([]*image.Paletted, len(ims))
+	}
+	var sum float64
+	npx := 0
+	for n, pi := range ims {
+		// remap table and error by index of pi.Palette
+		remap := make([]uint8, len(pi.Palette))
+		u := Usage(pi)
+		for i, c := range pi.Palette {
+			x := p.IndexNear(c)
+			remap[i] = uint8(x)
+			r, g, b, _ := c.RGBA()
+			sum += float64(u[i]) *
+				float64(sRGB{int32(r), int32(g), int32(b)}.dist(sp[x]))
+		}
+		b := pi.Rect
+		npx += b.Dx() * b.Dy()
+		if out == nil {
+			continue
+		}
+		o := image.NewPaletted(b, cp)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			row := pi.Pix[pi.PixOffset(b.Min.X, y):][:b.Dx()]
+			orow := o.Pix[o.PixOffset(b.Min.X, y):]
+			for x, i := range row {
+				if int(i) < len(remap) {
+					orow[x] = remap[i]
+				}
+			}
+		}
+		out[n] = o
+	}
+	if npx == 0 {
+		return out, 0
+	}
+	return out, sum / (0x101 * 0x101 * 3 * float64(npx))
+}
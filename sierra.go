@@ -4,6 +4,8 @@
 package quant
 
 import (
+	"errors"
+	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
@@ -11,7 +13,45 @@ import (
 )
 
 // Sierra24A satisfies draw.Drawer
-type Sierra24A struct{}
+//
+// The zero value uses Euclidean distance to find nearest palette colors.
+type Sierra24A struct {
+	// Metric is the distance used to find nearest palette colors.  With
+	// Manhattan, mapping is faster, and as error diffusion corrects each
+	// choice in neighboring pixels the loss of accuracy is rarely visible.
+	Metric Metric
+
+	// ErrorClamp, if > 0, limits the error diffused from each pixel to
+	// ErrorClamp in each channel, in 16 bit color units.  As the kernel
+	// weights sum to 1, the color sought for a pixel then differs from its
+	// original by no more than ErrorClamp per channel.
+	//
+	// Where image colors lie far outside the palette gamut, as with bright
+	// saturated areas and a dull palette, the same extreme palette color
+	// is chosen repeatedly and unlimited error accumulates, trailing off
+	// as colored streaks into neighboring areas.  ErrorClamp limits this
+	// bleeding at the cost of less accurate average color in such areas.
+	// A value around 0x2000 is a reasonable start.  Zero means no limit.
+	ErrorClamp uint16
+
+	// Scale, if > 1, dithers at reduced resolution for a chunky look.  The
+	// source is downsampled by averaging Scale × Scale blocks of pixels,
+	// dithered, and upscaled by repeating pixels.  The output resolution is
+	// the same as without Scale but dither dots are Scale × Scale blocks.
+	// Error diffusion then also covers 1/Scale² of the pixels.  Scale
+	// applies to Draw and DrawChecked.
+	Scale int
+
+	// Edge, if > 0, keeps error from diffusing across edges in the source
+	// image.  Error is not diffused from a pixel to a neighbor with a
+	// luminance differing by more than Edge, in 16 bit units.  That share
+	// of error is dropped.  Error then stays within smooth regions, keeping
+	// text and object boundaries crisp while gradients are still dithered.
+	// A value around 0x2000 is a reasonable start.  Zero means no edge
+	// detection.  With TileDitherer, edges across tile seams are not
+	// detected.
+	Edge uint16
+}
 
 var _ draw.Drawer = Sierra24A{}
 
@@ -22,10 +62,61 @@ var _ draw.Drawer = Sierra24A{}
 //
 //	  X 2
 //	1 1
+//
+// If dst is an *image.Paletted with more than 256 colors, dithering is not
+// possible and src is drawn as is, without dithering or quantization.  Use
+// DrawChecked to detect this case.
 func (d Sierra24A) Draw(dst draw.Image, r image.Rectangle, src image.Image, sp image.Point) {
+	drawPaletted(dst, r, src, sp, d.dither211)
+}
+
+// DitherFixed returns src dithered to a new image with palette cp, except
+// for pixels with fixed palette indexes.
+//
+// For each pixel, function fixed returns a palette index, or -1 if the
+// pixel is to be dithered.  Pixels with an index are set to it without
+// dithering.  Error diffused to them is dropped and they diffuse none, so
+// flat areas stay clean while neighboring areas are dithered.  A nil fixed
+// dithers all pixels.  Nil is returned if cp has more than 256 colors.
+func (d Sierra24A) DitherFixed(src image.Image, cp color.Palette, fixed func(x, y int) int) *image.Paletted {
+	if len(cp) > 256 {
+		return nil
+	}
+	b := src.Bounds()
+	pi := image.NewPaletted(b, cp)
+	if b.Empty() {
+		return pi
+	}
+	s := d.newDiffuser(b, newSPalette(cp))
+	s.fixed = fixed
+	s.tile(src, pi, nil)
+	return pi
+}
+
+// ErrPaletteSize is returned for palettes with more than the 256 colors
+// that image.Paletted can represent.
+var ErrPaletteSize = errors.New("quant: palette has more than 256 colors")
+
+// DrawChecked is Draw but returns an error rather than drawing src
+// undithered when dithering is not possible.
+//
+// If dst is an *image.Paletted with more than 256 colors, an error wrapping
+// ErrPaletteSize is returned and dst is not modified.
+func (d Sierra24A) DrawChecked(dst draw.Image, r image.Rectangle, src image.Image, sp image.Point) error {
+	if pd, ok := dst.(*image.Paletted); ok && len(pd.Palette) > 256 {
+		return fmt.Errorf("%w: dst palette has %d", ErrPaletteSize, len(pd.Palette))
+	}
+	d.Draw(dst, r, src, sp)
+	return nil
+}
+
+// drawPaletted implements Draw for drawers that require a paletted
+// destination and work on whole images.  Function f must return a new
+// paletted image of src with palette cp, or nil if that is not possible.
+func drawPaletted(dst draw.Image, r image.Rectangle, src image.Image, sp image.Point, f func(src image.Image, cp color.Palette) *image.Paletted) {
 	pd, ok := dst.(*image.Paletted)
 	if !ok {
-		// dither211 currently requires a palette
+		// f currently requires a palette
 		draw.Draw(dst, r, src, sp, draw.Src)
 		return
 	}
@@ -43,15 +134,14 @@ func (d Sierra24A) Draw(dst draw.Image, r image.Rectangle, src image.Image, sp i
 			SubImage(image.Rectangle) image.Image
 		})
 		if !ok {
-			// dither211 currently works on whole images
+			// f currently works on whole images
 			draw.Draw(dst, r, src, sp, draw.Src)
 			return
 		}
 		src = s.SubImage(sr)
 	}
-	// dither211 currently returns a new image, or nil if dithering not
-	// possible.
-	if s := dither211(src, pd.Palette); s != nil {
+	// f currently returns a new image, or nil if dithering not possible.
+	if s := f(src, pd.Palette); s != nil {
 		src = s
 	}
 	// this avoids any problem of src dst overlap but it would usually
@@ -64,17 +154,76 @@ func (d Sierra24A) Draw(dst draw.Image, r image.Rectangle, src image.Image, sp i
 type sRGB struct{ r, g, b int32 }
 type sPalette []sRGB
 
+// clamp limits color values to the range 0-ffff.
+func (c *sRGB) clamp() {
+	if c.r < 0 {
+		c.r = 0
+	} else if c.r > 0xffff {
+		c.r = 0xffff
+	}
+	if c.g < 0 {
+		c.g = 0
+	} else if c.g > 0xffff {
+		c.g = 0xffff
+	}
+	if c.b < 0 {
+		c.b = 0
+	} else if c.b > 0xffff {
+		c.b = 0xffff
+	}
+}
+
+// limit limits color values to the range -m to m.
+func (c *sRGB) limit(m int32) {
+	lim := func(v *int32) {
+		if *v < -m {
+			*v = -m
+		} else if *v > m {
+			*v = m
+		}
+	}
+	lim(&c.r)
+	lim(&c.g)
+	lim(&c.b)
+}
+
+// newSPalette converts a color.Palette to an sPalette.
+func newSPalette(cp color.Palette) sPalette {
+	sp := make(sPalette, len(cp))
+	for i, c := range cp {
+		r, g, b, _ := c.RGBA()
+		sp[i] = sRGB{int32(r), int32(g), int32(b)}
+	}
+	return sp
+}
+
+// dist returns the squared Euclidean distance between colors c and d.
+func (c sRGB) dist(d sRGB) int64 {
+	x := int64(c.r) - int64(d.r)
+	s := x * x
+	x = int64(c.g) - int64(d.g)
+	s += x * x
+	x = int64(c.b) - int64(d.b)
+	return s + x*x
+}
+
 func (p sPalette) index(c sRGB) int {
 	// still the awful linear search
 	i, min := 0, int64(math.MaxInt64)
 	for j, pc := range p {
-		d := int64(c.r) - int64(pc.r)
-		s := d * d
-		d = int64(c.g) - int64(pc.g)
-		s += d * d
-		d = int64(c.b) - int64(pc.b)
-		s += d * d
-		if s < min {
+		if s := c.dist(pc); s < min {
+			min = s
+			i = j
+		}
+	}
+	return i
+}
+
+// indexL1 is index using Manhattan rather than Euclidean distance.
+func (p sPalette) indexL1(c sRGB) int {
+	i, min := 0, int64(math.MaxInt64)
+	for j, pc := range p {
+		if s := c.distL1(pc); s < min {
 			min = s
 			i = j
 		}
@@ -82,77 +231,279 @@ func (p sPalette) index(c sRGB) int {
 	return i
 }
 
-// currently this is strictly a helper function for Dither211.Draw, so
+// indexFunc returns the index method for metric m.
+func (p sPalette) indexFunc(m Metric) func(sRGB) int {
+	if m == Manhattan {
+		return p.indexL1
+	}
+	return p.index
+}
+
+// distL1 returns the Manhattan distance between colors c and d.
+func (c sRGB) distL1(d sRGB) int64 {
+	abs := func(x int32) int64 {
+		if x < 0 {
+			return -int64(x)
+		}
+		return int64(x)
+	}
+	return abs(c.r-d.r) + abs(c.g-d.g) + abs(c.b-d.b)
+}
+
+// currently this is strictly a helper function for Sierra24A.Draw, so
 // not generalized to use Palette from this package.
-func dither211(i0 image.Image, cp color.Palette) *image.Paletted {
+func (d Sierra24A) dither211(i0 image.Image, cp color.Palette) *image.Paletted {
 	if len(cp) > 256 {
-		// representation limit of image.Paletted.  a little sketchy to return
-		// nil, but unworkable results are always better than wrong results.
+		// representation limit of image.Paletted.  Draw documents that src
+		// is then drawn as is, DrawChecked reports ErrPaletteSize.
 		return nil
 	}
+	if d.Scale > 1 {
+		return d.scaled(i0, cp)
+	}
+	return d.diffuse(i0, cp, newSPalette(cp), nil)
+}
+
+// scaled dithers i0 at resolution reduced by d.Scale.
+func (d Sierra24A) scaled(i0 image.Image, cp color.Palette) *image.Paletted {
+	s := d.Scale
+	b := i0.Bounds()
+	sm := downsample(i0, s)
+	d.Scale = 0
+	spi := d.diffuse(sm, cp, newSPalette(cp), nil)
+	// upscale
+	pi := image.NewPaletted(b, cp)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := pi.Pix[pi.PixOffset(b.Min.X, y):][:b.Dx()]
+		srow := spi.Pix[spi.PixOffset(0, (y-b.Min.Y)/s):]
+		for x := range row {
+			row[x] = srow[x/s]
+		}
+	}
+	return pi
+}
+
+// diffuse does the work of dither211 with sPalette sp corresponding to
+// color.Palette cp.  If adapt is not nil, it is called for each pixel with
+// the palette index chosen and the adjusted full color.
+func (d Sierra24A) diffuse(i0 image.Image, cp color.Palette, sp sPalette, adapt func(i int, afc sRGB)) *image.Paletted {
 	b := i0.Bounds()
 	pi := image.NewPaletted(b, cp)
 	if b.Empty() {
 		return pi // no work to do
 	}
-	sp := make(sPalette, len(cp))
-	for i, c := range cp {
-		r, g, b, _ := c.RGBA()
-		sp[i] = sRGB{int32(r), int32(g), int32(b)}
+	d.newDiffuser(b, sp).tile(i0, pi, adapt)
+	return pi
+}
+
+// diffuser holds error diffusion state for an image with bounds b.
+//
+// The state persists across calls to tile so that an image can be dithered
+// in tiles as if it were dithered whole.
+type diffuser struct {
+	sp    sPalette
+	index func(sRGB) int
+	limit int32              // error clamp, or 0 for none
+	edge  int32              // edge threshold, or 0 for none
+	fixed func(x, y int) int // see DitherFixed, or nil
+	b     image.Rectangle
+	dn    []sRGB // errors diffused down, by column
+	rt    []sRGB // errors diffused right across tile seams, by row
+}
+
+func (d Sierra24A) newDiffuser(b image.Rectangle, sp sPalette) *diffuser {
+	return &diffuser{
+		sp:    sp,
+		index: sp.indexFunc(d.Metric),
+		limit: int32(d.ErrorClamp),
+		edge:  int32(d.Edge),
+		b:     b,
+		dn:    make([]sRGB, b.Dx()+1),
+	}
+}
+
+// fixedIndex returns the fixed palette index for pixel x, y or -1 if the
+// pixel is to be dithered.
+func (s *diffuser) fixedIndex(x, y int) int {
+	if s.fixed == nil {
+		return -1
+	}
+	return s.fixed(x, y)
+}
+
+// edgeRows holds colors and luminances of the current and next rows of
+// pixels of a tile, for Sierra24A.Edge.  Each pixel is read once, with the
+// next row becoming the current row as the tile is dithered.
+type edgeRows struct {
+	i0       image.Image
+	b        image.Rectangle // bounds of i0
+	x0       int             // x of element 0, one left of the tile
+	cur, nxt []edgePx
+}
+
+type edgePx struct {
+	c  sRGB
+	l  int32 // luminance
+	in bool  // within the bounds of i0
+}
+
+// newEdgeRows returns edgeRows for dithering the pixels of i0 within r,
+// starting with row r.Min.Y.
+func newEdgeRows(i0 image.Image, r image.Rectangle) *edgeRows {
+	e := &edgeRows{
+		i0:  i0,
+		b:   i0.Bounds(),
+		x0:  r.Min.X - 1,
+		cur: make([]edgePx, r.Dx()+2),
+		nxt: make([]edgePx, r.Dx()+2),
+	}
+	e.read(e.cur, r.Min.Y)
+	e.read(e.nxt, r.Min.Y+1)
+	return e
+}
+
+// read reads row y of i0 into row.
+func (e *edgeRows) read(row []edgePx, y int) {
+	for k := range row {
+		x := e.x0 + k
+		if !(image.Point{x, y}).In(e.b) {
+			row[k] = edgePx{}
+			continue
+		}
+		r, g, b, _ := e.i0.At(x, y).RGBA()
+		row[k] = edgePx{sRGB{int32(r), int32(g), int32(b)}, luminance(r, g, b), true}
+	}
+}
+
+// advance makes row y the current row.
+func (e *edgeRows) advance(y int) {
+	e.cur, e.nxt = e.nxt, e.cur
+	e.read(e.nxt, y+1)
+}
+
+// edges reports whether there are edges between pixel x of the current
+// row and its neighbors right, down, and down left, for luminance
+// threshold th.  Neighbors outside the bounds of i0 are not considered
+// edges.
+func (e *edgeRows) edges(x int, th int32) (r, d, dl bool) {
+	k := x - e.x0
+	l := e.cur[k].l
+	edge := func(p edgePx) bool {
+		if !p.in {
+			return false
+		}
+		d := p.l - l
+		return d > th || d < -th
+	}
+	return edge(e.cur[k+1]), edge(e.nxt[k]), edge(e.nxt[k-1])
+}
+
+// tile dithers the pixels of i0 within pi.Rect, setting pixels of pi.
+// Tiles narrower than s.b must be dithered in raster order, see
+// TileDitherer.
+func (s *diffuser) tile(i0 image.Image, pi *image.Paletted, adapt func(i int, afc sRGB)) {
+	r := pi.Rect
+	seamL := r.Min.X > s.b.Min.X
+	seamR := r.Max.X < s.b.Max.X
+	if (seamL || seamR) && s.rt == nil {
+		s.rt = make([]sRGB, s.b.Dy())
 	}
+	dn := s.dn
 	// afc is adjustd full color.  e, rt, dn hold diffused errors.
-	var afc, e, rt sRGB
-	dn := make([]sRGB, b.Dx()+1)
-	for y := b.Min.Y; y < b.Max.Y; y++ {
-		rt = dn[0]
-		dn[0] = sRGB{}
-		for x := b.Min.X; x < b.Max.X; x++ {
-			// full color from original image
-			r0, g0, b0, _ := i0.At(x, y).RGBA()
-			// adjusted full color = original color + diffused error
-			afc.r = int32(r0) + rt.r>>2
-			afc.g = int32(g0) + rt.g>>2
-			afc.b = int32(b0) + rt.b>>2
-			// clipping or clamping is usually explained as necessary
-			// to avoid integer overflow but with palettes that do not
-			// represent the full color space of the image, it is needed
-			// to keep areas of excess color from saturating at palette
-			// limits and bleeding into neighboring areas.
-			if afc.r < 0 {
-				afc.r = 0
-			} else if afc.r > 0xffff {
-				afc.r = 0xffff
-			}
-			if afc.g < 0 {
-				afc.g = 0
-			} else if afc.g > 0xffff {
-				afc.g = 0xffff
-			}
-			if afc.b < 0 {
-				afc.b = 0
-			} else if afc.b > 0xffff {
-				afc.b = 0xffff
+	// lf holds error diffused down from the first column of a tile with
+	// a seam on the left.  It is held here rather than in dn because the
+	// tile on the left, which would otherwise carry it right, is finished.
+	var afc, e, rt, lf sRGB
+	// edges right, down, and down left of the current pixel
+	var eR, eD, eL bool
+	var er *edgeRows
+	if s.edge > 0 {
+		er = newEdgeRows(i0, r)
+	}
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		if er != nil && y > r.Min.Y {
+			er.advance(y)
+		}
+		if seamL {
+			c := s.rt[y-s.b.Min.Y]
+			rt = sRGB{c.r + lf.r, c.g + lf.g, c.b + lf.b}
+			lf = sRGB{}
+		} else {
+			rt = dn[0]
+			dn[0] = sRGB{}
+		}
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if i := s.fixedIndex(x, y); i >= 0 {
+				// fixed pixel, set without dithering.  error diffused
+				// to it is dropped and it diffuses none.
+				pi.SetColorIndex(x, y, uint8(i))
+				e = sRGB{}
+				eR, eD, eL = false, false, false
+			} else {
+				// full color from original image
+				var c0 sRGB
+				if er != nil {
+					c0 = er.cur[x-er.x0].c
+				} else {
+					r0, g0, b0, _ := i0.At(x, y).RGBA()
+					c0 = sRGB{int32(r0), int32(g0), int32(b0)}
+				}
+				// adjusted full color = original color + diffused error
+				afc.r = c0.r + rt.r>>2
+				afc.g = c0.g + rt.g>>2
+				afc.b = c0.b + rt.b>>2
+				// clipping or clamping is usually explained as necessary
+				// to avoid integer overflow but with palettes that do not
+				// represent the full color space of the image, it is needed
+				// to keep areas of excess color from saturating at palette
+				// limits and bleeding into neighboring areas.
+				afc.clamp()
+				// nearest palette entry
+				i := s.index(afc)
+				// set pixel in destination image
+				pi.SetColorIndex(x, y, uint8(i))
+				if adapt != nil {
+					adapt(i, afc)
+				}
+				// error to be diffused = full color - palette color.
+				pc := s.sp[i]
+				e.r = afc.r - pc.r
+				e.g = afc.g - pc.g
+				e.b = afc.b - pc.b
+				if s.limit > 0 {
+					e.limit(s.limit)
+				}
+				if er != nil {
+					eR, eD, eL = er.edges(x, s.edge)
+				}
 			}
-			// nearest palette entry
-			i := sp.index(afc)
-			// set pixel in destination image
-			pi.SetColorIndex(x, y, uint8(i))
-			// error to be diffused = full color - palette color.
-			pc := sp[i]
-			e.r = afc.r - pc.r
-			e.g = afc.g - pc.g
-			e.b = afc.b - pc.b
 			// half of error*4 goes right
-			dx := x - b.Min.X + 1
-			rt.r = dn[dx].r + e.r*2
-			rt.g = dn[dx].g + e.g*2
-			rt.b = dn[dx].b + e.b*2
+			dx := x - s.b.Min.X + 1
+			rt = dn[dx]
+			if !eR {
+				rt.r += e.r * 2
+				rt.g += e.g * 2
+				rt.b += e.b * 2
+			}
 			// the other half goes down
-			dn[dx] = e
-			dn[dx-1].r += e.r
-			dn[dx-1].g += e.g
-			dn[dx-1].b += e.b
+			if dn[dx] = e; eD {
+				dn[dx] = sRGB{}
+			}
+			if seamL && x == r.Min.X && y < r.Max.Y-1 {
+				// down left share, as below
+				if lf = e; eL {
+					lf = sRGB{}
+				}
+				continue
+			}
+			if !eL {
+				dn[dx-1].r += e.r
+				dn[dx-1].g += e.g
+				dn[dx-1].b += e.b
+			}
+		}
+		if seamR {
+			s.rt[y-s.b.Min.Y] = rt
 		}
 	}
-	return pi
 }
@@ -0,0 +1,143 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package quant
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// Sierra3 satisfies draw.Drawer, implementing the three row Sierra
+// dithering filter.
+//
+// It diffuses error over more neighbors than Sierra2 or Sierra24A, giving
+// smoother results at some cost in speed.  The zero value uses Euclidean
+// distance to find nearest palette colors.
+type Sierra3 struct {
+	// Metric is the distance used to find nearest palette colors.
+	Metric Metric
+}
+
+var _ draw.Drawer = Sierra3{}
+
+// Draw performs error diffusion dithering.
+//
+// This method satisfies the draw.Drawer interface, implementing the
+// filter attributed to Frankie Sierra with the kernel
+//
+//	        X   5   3
+//	2   4   5   4   2
+//	    2   3   2       (1/32)
+//
+// As with Sierra24A, dst must be an *image.Paletted of no more than 256
+// colors for dithering to be done.
+func (d Sierra3) Draw(dst draw.Image, r image.Rectangle, src image.Image, sp image.Point) {
+	drawPaletted(dst, r, src, sp, func(src image.Image, cp color.Palette) *image.Paletted {
+		return sierra3Kernel.diffuse(src, cp, d.Metric)
+	})
+}
+
+// Sierra2 satisfies draw.Drawer, implementing the two row Sierra
+// dithering filter.
+//
+// It is intermediate in quality and speed between Sierra3 and Sierra24A.
+// The zero value uses Euclidean distance to find nearest palette colors.
+type Sierra2 struct {
+	// Metric is the distance used to find nearest palette colors.
+	Metric Metric
+}
+
+var _ draw.Drawer = Sierra2{}
+
+// Draw performs error diffusion dithering.
+//
+// This method satisfies the draw.Drawer interface, implementing the
+// filter attributed to Frankie Sierra with the kernel
+//
+//	        X   4   3
+//	1   2   3   2   1   (1/16)
+//
+// As with Sierra24A, dst must be an *image.Paletted of no more than 256
+// colors for dithering to be done.
+func (d Sierra2) Draw(dst draw.Image, r image.Rectangle, src image.Image, sp image.Point) {
+	drawPaletted(dst, r, src, sp, func(src image.Image, cp color.Palette) *image.Paletted {
+		return sierra2Kernel.diffuse(src, cp, d.Metric)
+	})
+}
+
+// kernel is an error diffusion kernel of up to three rows, with weights
+// reaching two columns either side of the current pixel.
+type kernel struct {
+	div int32
+	w   []kernelWeight
+}
+
+// kernelWeight is the weight of error diffused to the pixel dx, dy from
+// the current pixel.
+type kernelWeight struct {
+	dx, dy, w int32
+}
+
+var sierra3Kernel = kernel{32, []kernelWeight{
+	{1, 0, 5}, {2, 0, 3},
+	{-2, 1, 2}, {-1, 1, 4}, {0, 1, 5}, {1, 1, 4}, {2, 1, 2},
+	{-1, 2, 2}, {0, 2, 3}, {1, 2, 2},
+}}
+
+var sierra2Kernel = kernel{16, []kernelWeight{
+	{1, 0, 4}, {2, 0, 3},
+	{-2, 1, 1}, {-1, 1, 2}, {0, 1, 3}, {1, 1, 2}, {2, 1, 1},
+}}
+
+// diffuse returns src dithered to a new image with palette cp, or nil if
+// cp has more than 256 colors.
+func (k kernel) diffuse(src image.Image, cp color.Palette, m Metric) *image.Paletted {
+	if len(cp) > 256 {
+		return nil
+	}
+	b := src.Bounds()
+	pi := image.NewPaletted(b, cp)
+	if b.Empty() {
+		return pi
+	}
+	sp := newSPalette(cp)
+	index := sp.indexFunc(m)
+	// errors*div for the current and next two rows, offset by two columns
+	// so that columns either side of the image have a place.
+	var rows [3][]sRGB
+	for i := range rows {
+		rows[i] = make([]sRGB, b.Dx()+4)
+	}
+	var afc, e sRGB
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		cur := rows[0]
+		for x := 0; x < b.Dx(); x++ {
+			r0, g0, b0, _ := src.At(b.Min.X+x, y).RGBA()
+			ce := cur[x+2]
+			afc.r = int32(r0) + ce.r/k.div
+			afc.g = int32(g0) + ce.g/k.div
+			afc.b = int32(b0) + ce.b/k.div
+			afc.clamp()
+			i := index(afc)
+			pi.Pix[pi.PixOffset(b.Min.X+x, y)] = uint8(i)
+			pc := sp[i]
+			e.r = afc.r - pc.r
+			e.g = afc.g - pc.g
+			e.b = afc.b - pc.b
+			for _, kw := range k.w {
+				t := &rows[kw.dy][int32(x)+2+kw.dx]
+				t.r += e.r * kw.w
+				t.g += e.g * kw.w
+				t.b += e.b * kw.w
+			}
+		}
+		// rotate rows, clearing the new last row
+		rows[0], rows[1], rows[2] = rows[1], rows[2], rows[0]
+		for i := range rows[2] {
+			rows[2][i] = sRGB{}
+		}
+	}
+	return pi
+}
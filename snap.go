@@ -0,0 +1,70 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package quant
+
+import "image/color"
+
+// WebSafe is the grid argument to Snap for the 216 color web-safe palette.
+const WebSafe = 6
+
+// Snap rounds each color of palette p to the nearest point of a regular
+// grid with the given number of levels per RGB channel, for example WebSafe.
+// If grid is less than 2, p is returned unchanged.  Grid values over 65536,
+// which exceed the precision of color values, are taken as 65536.  Alpha is
+// preserved.  Translucent colors are snapped in non-premultiplied values,
+// so that their color rather than their premultiplied values lie on the
+// grid.
+//
+// Palette size and indexes are preserved.  Colors that snap to the same
+// grid point are kept as duplicates, so images already mapped to p remain
+// valid for the result.  For a TreePalette the result is a TreePalette with
+// the same tree, so IndexNear also gives the same results as with p.  For
+// a ManhattanPalette the result is a ManhattanPalette.  For other palettes
+// the result is a LinearPalette.
+func Snap(p Palette, grid int) Palette {
+	switch {
+	case grid < 2:
+		return p
+	case grid > 0x10000:
+		grid = 0x10000
+	}
+	l := uint32(grid - 1)
+	snap := func(c color.Color) color.RGBA64 {
+		r, g, b, a := c.RGBA()
+		if a == 0 {
+			return color.RGBA64{}
+		}
+		s := func(v uint32) uint16 {
+			v = v * 0xffff / a // non-premultiplied
+			v = (v*l + 0x7fff) / 0xffff * 0xffff / l
+			return uint16(v * a / 0xffff)
+		}
+		return color.RGBA64{s(r), s(g), s(b), uint16(a)}
+	}
+	if t, ok := p.(TreePalette); ok {
+		var cp func(*Node) *Node
+		cp = func(n *Node) *Node {
+			c := *n
+			if n.Type == TLeaf {
+				c.Color = snap(n.Color)
+			} else {
+				c.Low = cp(n.Low)
+				c.High = cp(n.High)
+			}
+			return &c
+		}
+		if t.Root != nil {
+			t.Root = cp(t.Root)
+		}
+		return t
+	}
+	var sp color.Palette
+	for _, c := range p.ColorPalette() {
+		sp = append(sp, snap(c))
+	}
+	if _, ok := p.(ManhattanPalette); ok {
+		return ManhattanPalette{sp}
+	}
+	return LinearPalette{sp}
+}
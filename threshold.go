@@ -0,0 +1,124 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package quant
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// Threshold1Bit satisfies draw.Drawer, implementing error diffusion
+// dithering to two colors, such as for document scans or receipt printers.
+//
+// It is a specialization of Sierra24A for two color output.  Pixels are
+// compared to the two colors by luminance alone and error is diffused in
+// the one dimension of luminance, which is faster than nearest color
+// search in RGB.  Output is an *image.Paletted of two colors, one byte per
+// pixel as with other image.Paletted images, not a packed bit image.
+type Threshold1Bit struct {
+	// Dark and Light are the two output colors.  Nil values mean black
+	// and white.
+	Dark, Light color.Color
+}
+
+var _ draw.Drawer = Threshold1Bit{}
+
+// Palette returns the two output colors, Dark at index 0 and Light at
+// index 1.
+func (d Threshold1Bit) Palette() color.Palette {
+	p := color.Palette{color.Black, color.White}
+	if d.Dark != nil {
+		p[0] = d.Dark
+	}
+	if d.Light != nil {
+		p[1] = d.Light
+	}
+	return p
+}
+
+// Draw performs two color dithering.
+//
+// This method satisfies the draw.Drawer interface.  As with Sierra24A,
+// dst must be an *image.Paletted for dithering to be done.  Pixels are set
+// to the indexes of the dst palette colors nearest Dark and Light.
+func (d Threshold1Bit) Draw(dst draw.Image, r image.Rectangle, src image.Image, sp image.Point) {
+	drawPaletted(dst, r, src, sp, func(src image.Image, cp color.Palette) *image.Paletted {
+		p := d.Palette()
+		pi := image.NewPaletted(src.Bounds(), cp)
+		if len(cp) > 0 && len(cp) <= 256 {
+			d.dither(src, pi, uint8(cp.Index(p[0])), uint8(cp.Index(p[1])))
+		}
+		return pi
+	})
+}
+
+// Dither returns src dithered to a new two color image with palette
+// d.Palette().
+func (d Threshold1Bit) Dither(src image.Image) *image.Paletted {
+	pi := image.NewPaletted(src.Bounds(), d.Palette())
+	d.dither(src, pi, 0, 1)
+	return pi
+}
+
+// dither sets pixels of pi to index i0 for Dark or i1 for Light.
+func (d Threshold1Bit) dither(src image.Image, pi *image.Paletted, i0, i1 uint8) {
+	p := d.Palette()
+	diffuseLevels(src, pi, []int32{lum(p[0]), lum(p[1])}, []uint8{i0, i1})
+}
+
+// lum returns the luminance of c.
+func lum(c color.Color) int32 {
+	r, g, b, _ := c.RGBA()
+	return luminance(r, g, b)
+}
+
+// diffuseLevels performs error diffusion dithering of src in the one
+// dimension of luminance.  Each pixel of pi is set to the index in idx
+// corresponding to the nearest luminance in levels.
+func diffuseLevels(src image.Image, pi *image.Paletted, levels []int32, idx []uint8) {
+	b := pi.Rect
+	if b.Empty() || len(levels) == 0 {
+		return
+	}
+	abs := func(x int32) int32 {
+		if x < 0 {
+			return -x
+		}
+		return x
+	}
+	// errors*4 diffused to the current and next row, offset by one column
+	// so that the column left of the image has a place.
+	w := b.Dx()
+	cur := make([]int32, w+2)
+	nxt := make([]int32, w+2)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := pi.Pix[pi.PixOffset(b.Min.X, y):]
+		for x := 0; x < w; x++ {
+			v := lum(src.At(b.Min.X+x, y)) + cur[x+1]>>2
+			if v < 0 {
+				v = 0
+			} else if v > 0xffff {
+				v = 0xffff
+			}
+			n := 0 // nearest level
+			for j, l := range levels {
+				if abs(v-l) < abs(v-levels[n]) {
+					n = j
+				}
+			}
+			row[x] = idx[n]
+			// kernel  X 2
+			//       1 1
+			e := v - levels[n]
+			cur[x+2] += e * 2
+			nxt[x] += e
+			nxt[x+1] += e
+		}
+		cur, nxt = nxt, cur
+		for x := range nxt {
+			nxt[x] = 0
+		}
+	}
+}
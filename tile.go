@@ -0,0 +1,48 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package quant
+
+import (
+	"image"
+	"image/color"
+)
+
+// TileDitherer performs Sierra24A dithering of an image supplied in tiles.
+//
+// Error diffused across tile seams is carried from tile to tile so results
+// are the same as dithering the whole image at once.  This allows dithering
+// images too large to hold in memory.  A palette for such an image can be
+// derived once for all tiles, for example by adding each tile to a
+// median.Histogrammer, which counts the pixels of each tile as it is added
+// and does not retain tiles.
+//
+// Tiles must form a grid and must be dithered in raster order, that is,
+// rows of tiles from top to bottom and tiles within a row from left to
+// right.
+type TileDitherer struct {
+	cp color.Palette
+	s  *diffuser
+}
+
+// NewTileDitherer returns a TileDitherer for an image with bounds b, to be
+// dithered to palette cp with Sierra24A d.
+func NewTileDitherer(d Sierra24A, b image.Rectangle, cp color.Palette) *TileDitherer {
+	return &TileDitherer{cp, d.newDiffuser(b, newSPalette(cp))}
+}
+
+// Dither dithers the next tile, returning a paletted image with the bounds
+// of the tile.  Tile bounds are clipped to the image bounds.
+//
+// As with Sierra24A, nil is returned if the palette has more than 256
+// colors.
+func (t *TileDitherer) Dither(tile image.Image) *image.Paletted {
+	if len(t.cp) > 256 {
+		return nil
+	}
+	pi := image.NewPaletted(tile.Bounds().Intersect(t.s.b), t.cp)
+	if !pi.Rect.Empty() {
+		t.s.tile(tile, pi, nil)
+	}
+	return pi
+}
@@ -0,0 +1,21 @@
+// Copyright 2013 Sonia Keys.
+// Licensed under MIT license.  See "license" file in this source tree.
+
+package quant
+
+import "time"
+
+// Timing holds time spent in phases of clustering, for profiling quantizer
+// internals without a profiler.
+//
+// Quantizers of this source tree take an optional *Timing in their Config
+// and add to its fields as they cluster.  Reading pixels and generating
+// results are not timed.
+type Timing struct {
+	// Scan is time spent finding color ranges and priorities of clusters.
+	Scan time.Duration
+	// Cut is time spent finding values at which to split clusters.
+	Cut time.Duration
+	// Split is time spent dividing pixels of clusters at cut values.
+	Split time.Duration
+}